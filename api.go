@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -13,6 +17,12 @@ func main() {
 
 	rdb := NewRedisClient(config.RedisAddr)
 
+	// Only /export reads Postgres
+	db, err := NewDBManager(config.LeaderDSN, config.FollowerDSN)
+	if err != nil {
+		log.Printf("⚠️  Postgres unavailable, /export disabled: %v", err)
+	}
+
 	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		stats := GetStats(rdb)
 		w.Header().Set("Content-Type", "application/json")
@@ -20,19 +30,219 @@ func main() {
 	})
 
 	http.HandleFunc("/results", func(w http.ResponseWriter, r *http.Request) {
-		results, _ := rdb.LRange(ctx, "results", 0, 99).Result()
+		region := r.URL.Query().Get("region")
+
+		// Filtering by region scans a wider window so it can still fill 100
+		var stop int64 = 99
+		if region != "" {
+			stop = 999
+		}
+		results, _ := rdb.LRange(ctx, "results", 0, stop).Result()
 
 		var urlResults []URLResult
 		for _, result := range results {
-			var res URLResult
-			json.Unmarshal([]byte(result), &res)
+			res, err := DecodeResult([]byte(result))
+			if err != nil {
+				continue
+			}
+			if region != "" && res.Region != region {
+				continue
+			}
 			urlResults = append(urlResults, res)
+			if len(urlResults) == 100 {
+				break
+			}
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(urlResults)
 	})
 
+	// Every stored check matching the filters (see ParseExportFilter), oldest
+	// first, streamed as ?format=csv (default), jsonl or parquet. A failure
+	// after the first byte aborts the response, so a truncated export never
+	// looks complete. Each export holds a follower connection for up to
+	// EXPORT_TIMEOUT, so only EXPORT_CONCURRENCY run at once.
+	exports := make(chan struct{}, max(config.ExportConcurrency, 1))
+	http.HandleFunc("/export", adminOnly(config.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		if db == nil {
+			http.Error(w, "Postgres is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case exports <- struct{}{}:
+			defer func() { <-exports }()
+		default:
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many exports running", http.StatusTooManyRequests)
+			return
+		}
+		query := r.URL.Query()
+		format, err := ParseExportFormat(query.Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := ParseExportFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cursor, err := QueryExport(r.Context(), db, filter, time.Duration(config.ExportTimeout)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer cursor.Close()
+
+		w.Header().Set("Content-Type", ExportContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="checks.%s"`, format))
+		out, _ := NewExportWriter(format, w)
+		if rows, err := cursor.Copy(out); err != nil {
+			log.Printf("❌ Export failed after %d rows: %v", rows, err)
+			panic(http.ErrAbortHandler)
+		}
+	}))
+
+	http.HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		type regionSummary struct {
+			RegionStats
+			RecentChecks  int     `json:"recent_checks"`
+			RecentErrors  int     `json:"recent_errors"`
+			AvgDurationMs float64 `json:"avg_duration_ms"`
+		}
+
+		summaries := make(map[string]*regionSummary)
+		for _, stats := range GetRegionStats(rdb) {
+			summaries[stats.Region] = &regionSummary{RegionStats: stats}
+		}
+
+		// Compare locations on the same recent window of results
+		results, _ := rdb.LRange(ctx, "results", 0, 999).Result()
+		totalDuration := make(map[string]int64)
+		for _, result := range results {
+			res, err := DecodeResult([]byte(result))
+			if err != nil {
+				continue
+			}
+			region := res.Region
+			if region == "" {
+				region = defaultRegion
+			}
+			summary, ok := summaries[region]
+			if !ok {
+				summary = &regionSummary{RegionStats: RegionStats{Region: region}}
+				summaries[region] = summary
+			}
+			summary.RecentChecks++
+			if res.Error != "" {
+				summary.RecentErrors++
+			}
+			totalDuration[region] += res.Duration
+		}
+
+		for region, summary := range summaries {
+			if summary.RecentChecks > 0 {
+				summary.AvgDurationMs = float64(totalDuration[region]) / float64(summary.RecentChecks)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summaries)
+	})
+
+	http.HandleFunc("/consensus", func(w http.ResponseWriter, r *http.Request) {
+		decisions, err := GetConsensusDecisions(ctx, rdb, 100)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(decisions)
+	})
+
+	// Up/down transitions after ?cursor= (from the start without one), at most
+	// ?limit= of them. With ?wait= (seconds) the request waits for the next
+	// event when there is none yet. Pass next_cursor back to keep reading.
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		cursor := query.Get("cursor")
+		if !ValidStateCursor(cursor) {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		limit = min(limit, 1000)
+		wait, _ := strconv.Atoi(query.Get("wait"))
+		wait = min(max(wait, 0), 30)
+
+		events, next, err := ReadStateEvents(r.Context(), rdb, cursor, int64(limit), time.Duration(wait)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if events == nil {
+			events = []StateEvent{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"events": events, "next_cursor": next})
+	})
+
+	http.HandleFunc("/security/regressions", func(w http.ResponseWriter, r *http.Request) {
+		regressions, err := GetSecurityRegressions(ctx, rdb)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(regressions)
+	})
+
+	http.HandleFunc("/cache/purge", adminOnly(config.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "use POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+
+		inv := CacheInvalidation{URL: r.URL.Query().Get("url"), Prefix: r.URL.Query().Get("prefix")}
+		deleted, err := PurgeCache(ctx, rdb, inv)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"purged": inv, "l2_keys_deleted": deleted})
+	}))
+
+	http.HandleFunc("/cache/refresh", adminOnly(config.AdminToken, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "missing url", http.StatusBadRequest)
+			return
+		}
+		deleted, err := RefreshCache(ctx, rdb, url)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"refreshing": url, "l2_keys_deleted": deleted})
+	}))
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		if err := rdb.Ping(ctx).Err(); err != nil {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -46,8 +256,38 @@ func main() {
 	log.Println("API Server starting on :8080")
 	log.Println("Endpoints:")
 	log.Println("  GET /stats   - Current statistics")
-	log.Println("  GET /results - Last 100 results")
+	log.Println("  GET /results - Last 100 results (?region= to filter)")
+	log.Println("  GET /export  - Stored checks as csv/jsonl/parquet (?format=&run=&from=&to=&status=&domain=&tag=&worker=&region=, Bearer ADMIN_TOKEN)")
+	log.Println("  GET /regions - Results broken down by region")
+	log.Println("  GET /consensus - Latest multi-location outage decisions")
+	log.Println("  GET /events  - Up/down transitions (?cursor=&limit=&wait=)")
+	log.Println("  GET /security/regressions - URLs whose security score dropped")
+	log.Println("  POST /cache/purge?url=|prefix= - Purge L1+L2 on every worker (Bearer ADMIN_TOKEN)")
+	log.Println("  POST /cache/refresh?url= - Purge and re-check from origin (Bearer ADMIN_TOKEN)")
 	log.Println("  GET /health  - Health check")
 
+	if config.AdminToken == "" {
+		log.Println("⚠️  ADMIN_TOKEN not set, /cache/purge, /cache/refresh and /export disabled")
+	}
+
 	http.ListenAndServe(":8080", nil)
 }
+
+// adminOnly guards endpoints that change state on every worker or read the
+// whole checks table. They need "Authorization: Bearer <token>", and are
+// disabled when no token is set.
+func adminOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "disabled: set ADMIN_TOKEN, or use cache_admin.go / export.go", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func main() {
+	// Skip the .go files passed to `go run`
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if !strings.HasSuffix(arg, ".go") {
+			args = append(args, arg)
+		}
+	}
+
+	if len(args) < 2 || (args[0] != "warm" && len(args) != 2) || len(args) > 3 {
+		log.Fatal("Usage: go run cache_admin.go common.go config.go cache_invalidation.go cache_policy.go cache_codec.go cache_warmup.go db_manager.go result_envelope.go\n" +
+			"         <purge|purge-prefix|refresh> <url|prefix>\n" +
+			"         warm <results|postgres> [limit]\n" +
+			"         warm file <urls_file>")
+	}
+
+	// Load config
+	config := LoadConfig()
+
+	// Connect to Redis
+	rdb := NewRedisClient(config.RedisAddr)
+	defer rdb.Close()
+
+	command, target := args[0], args[1]
+	if command == "warm" {
+		warm(config, rdb, target, args[2:])
+		return
+	}
+
+	var deleted int64
+	var err error
+	switch command {
+	case "purge":
+		deleted, err = PurgeCache(ctx, rdb, CacheInvalidation{URL: target})
+	case "purge-prefix":
+		deleted, err = PurgeCache(ctx, rdb, CacheInvalidation{Prefix: target})
+	case "refresh":
+		deleted, err = RefreshCache(ctx, rdb, target)
+	default:
+		log.Fatalf("unknown command %q (want purge, purge-prefix or refresh)", command)
+	}
+	if err != nil {
+		log.Fatalf("❌ %s failed: %v", command, err)
+	}
+
+	log.Printf("✅ %s %s: deleted %d L2 keys, workers notified to evict L1\n", command, target, deleted)
+}
+
+func warm(config AppConfig, rdb *redis.Client, source string, args []string) {
+	policy, err := NewCachePolicy(config)
+	if err != nil {
+		log.Fatalf("❌ invalid cache policy: %v", err)
+	}
+
+	limit := config.ResultsToKeep
+	if len(args) > 0 && source != "file" {
+		if limit, err = strconv.Atoi(args[0]); err != nil || limit <= 0 {
+			log.Fatalf("invalid limit %q", args[0])
+		}
+	}
+
+	var results []URLResult
+	var urls []string
+	switch source {
+	case "results":
+		results, err = RecentResults(ctx, rdb, limit)
+	case "postgres":
+		db, dbErr := NewDBManager(config.LeaderDSN, config.FollowerDSN)
+		if dbErr != nil {
+			log.Fatalf("❌ could not connect to Postgres: %v", dbErr)
+		}
+		defer db.Close()
+		results, err = RecentChecks(ctx, db, limit)
+	case "file":
+		if len(args) != 1 {
+			log.Fatal("warm file needs a urls file")
+		}
+		urls, err = ReadURLList(args[0])
+	default:
+		log.Fatalf("unknown warm source %q (want results, postgres or file)", source)
+	}
+	if err != nil {
+		log.Fatalf("❌ reading %s failed: %v", source, err)
+	}
+
+	// The regions the producer targets; GetRegions also lists retired
+	// regions whose queues no worker reads any more
+	regions := config.Regions
+	if len(regions) == 0 {
+		regions = []string{defaultRegion}
+	}
+	log.Printf("🔥 Warming L2 from %s: %d results, %d URLs (%d origin checks/sec max)\n",
+		source, len(results), len(urls), config.CacheWarmRate)
+
+	warmer := NewCacheWarmer(rdb, policy, config.CacheWarmRate, regions)
+	report, err := warmer.Warm(ctx, results, urls, time.Duration(config.CacheWarmWait)*time.Second)
+	if err != nil {
+		log.Fatalf("❌ warm-up failed: %v", err)
+	}
+
+	fmt.Printf("\n"+
+		"════════════════════════════════════════\n"+
+		"🔥 WARM-UP REPORT (took %s)\n"+
+		"════════════════════════════════════════\n"+
+		"Targets:       %6d\n"+
+		"Already warm:  %6d\n"+
+		"Seeded:        %6d  ← written from stored results\n"+
+		"Enqueued:      %6d  ← origin checks for workers\n"+
+		"Not cacheable: %6d\n"+
+		"Other regions: %6d  ← not in REGIONS\n"+
+		"════════════════════════════════════════\n"+
+		"Coverage:      %5.1f%% (%d/%d keys in L2)\n",
+		report.Elapsed.Round(time.Millisecond),
+		report.Targets, report.AlreadyWarm, report.Seeded, report.Enqueued, report.Skipped, report.OtherRegions,
+		report.Coverage(), report.Covered, report.Targets)
+	for _, region := range report.SortedRegions() {
+		counts := report.Regions[region]
+		fmt.Printf("  %-12s %d/%d\n", region, counts[0], counts[1])
+	}
+	fmt.Println("════════════════════════════════════════")
+}
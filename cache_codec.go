@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// L2 entries start with a magic byte and a format version so a worker never
+// mistakes another layout (or the old JSON entries, which start with '{') for
+// a result. Bump cacheFormatVersion whenever the fields below change, and
+// keep decoding the versions before it so a rolling deploy doesn't turn every
+// entry into a miss:
+//
+//	1: the result fields
+//	2: run ID, attempt and check type appended
+const (
+	cacheFormatMagic   byte = 0xCA
+	cacheFormatVersion byte = 2
+
+	cacheFlagCompressed byte = 1 << 0
+)
+
+var (
+	errCacheVersion = errors.New("cache entry has an unknown format version")
+	errCacheCorrupt = errors.New("cache entry is corrupt")
+)
+
+// CacheCodec encodes URLResults for L2. Payloads of at least CompressMin
+// bytes are deflated when Compress is set; decoding handles both either way.
+type CacheCodec struct {
+	Compress    bool
+	CompressMin int
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders sync.Pool
+
+// inflate decompresses a whole payload, rejecting bytes after the final block
+func inflate(payload []byte) ([]byte, error) {
+	src := bytes.NewReader(payload)
+	r, ok := flateReaders.Get().(io.ReadCloser)
+	if ok {
+		r.(flate.Resetter).Reset(src, nil)
+	} else {
+		r = flate.NewReader(src)
+	}
+	defer flateReaders.Put(r)
+
+	inflated, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if src.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes after compressed data", src.Len())
+	}
+	return inflated, nil
+}
+
+// Encode writes the header followed by the result's fields. ServedBy and
+// AgeMs are stamped when a result is served, so they are not stored.
+func (c CacheCodec) Encode(result URLResult) []byte {
+	var e cacheEncoder
+	e.string(result.CheckID)
+	e.string(result.URL)
+	e.varint(int64(result.Status))
+	e.string(result.Error)
+	e.string(result.ErrorKind)
+	e.varint(result.Duration)
+	e.time(result.CheckedAt)
+	e.string(result.WorkerID)
+	e.string(result.Region)
+	e.string(result.Protocol)
+	e.bool(result.PartialOutage)
+
+	e.bool(result.SecurityAudit != nil)
+	if audit := result.SecurityAudit; audit != nil {
+		e.varint(int64(audit.Score))
+		e.time(audit.AuditedAt)
+		e.uvarint(uint64(len(audit.Findings)))
+		for _, f := range audit.Findings {
+			e.string(f.Check)
+			e.string(f.Severity)
+			e.string(f.Message)
+		}
+	}
+
+	e.uvarint(uint64(len(result.Families)))
+	for _, f := range result.Families {
+		e.string(f.Family)
+		e.varint(int64(f.Status))
+		e.string(f.Error)
+		e.varint(f.Duration)
+		e.string(f.Protocol)
+		e.string(f.RemoteAddr)
+		e.bool(f.Skipped)
+	}
+
+	// Version 2
+	e.string(result.RunID)
+	e.varint(int64(result.Attempt))
+	e.string(result.CheckType)
+
+	payload := e.buf
+	flags := byte(0)
+	if c.Compress && len(payload) >= c.CompressMin {
+		var compressed bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&compressed)
+		w.Write(payload)
+		w.Close()
+		flateWriters.Put(w)
+
+		// Tiny or random payloads can grow; keep whichever is smaller
+		if compressed.Len() < len(payload) {
+			payload = compressed.Bytes()
+			flags |= cacheFlagCompressed
+		}
+	}
+
+	data := make([]byte, 0, len(payload)+3)
+	data = append(data, cacheFormatMagic, cacheFormatVersion, flags)
+	return append(data, payload...)
+}
+
+// Decode reads this and every earlier version. It returns errCacheVersion
+// for entries written in a newer or foreign format and errCacheCorrupt for
+// anything that doesn't parse; both are cache misses.
+func (c CacheCodec) Decode(data []byte) (URLResult, error) {
+	if len(data) < 3 || data[0] != cacheFormatMagic {
+		return URLResult{}, errCacheVersion
+	}
+	version := data[1]
+	if version < 1 || version > cacheFormatVersion {
+		return URLResult{}, errCacheVersion
+	}
+
+	flags, payload := data[2], data[3:]
+	if flags&^cacheFlagCompressed != 0 {
+		return URLResult{}, fmt.Errorf("%w: unknown flags %#x", errCacheCorrupt, flags)
+	}
+	if flags&cacheFlagCompressed != 0 {
+		inflated, err := inflate(payload)
+		if err != nil {
+			return URLResult{}, fmt.Errorf("%w: %v", errCacheCorrupt, err)
+		}
+		payload = inflated
+	}
+
+	d := cacheDecoder{buf: payload}
+	var result URLResult
+	result.CheckID = d.string()
+	result.URL = d.string()
+	result.Status = int(d.varint())
+	result.Error = d.string()
+	result.ErrorKind = d.string()
+	result.Duration = d.varint()
+	result.CheckedAt = d.time()
+	result.WorkerID = d.string()
+	result.Region = d.string()
+	result.Protocol = d.string()
+	result.PartialOutage = d.bool()
+
+	if d.bool() {
+		audit := &SecurityAudit{}
+		audit.Score = int(d.varint())
+		audit.AuditedAt = d.time()
+		if n := d.count(); n > 0 {
+			audit.Findings = make([]SecurityFinding, n)
+			for i := range audit.Findings {
+				audit.Findings[i] = SecurityFinding{Check: d.string(), Severity: d.string(), Message: d.string()}
+			}
+		}
+		result.SecurityAudit = audit
+	}
+
+	if n := d.count(); n > 0 {
+		result.Families = make([]FamilyResult, n)
+		for i := range result.Families {
+			f := &result.Families[i]
+			f.Family = d.string()
+			f.Status = int(d.varint())
+			f.Error = d.string()
+			f.Duration = d.varint()
+			f.Protocol = d.string()
+			f.RemoteAddr = d.string()
+			f.Skipped = d.bool()
+		}
+	}
+
+	if version >= 2 {
+		result.RunID = d.string()
+		result.Attempt = int(d.varint())
+		result.CheckType = d.string()
+	}
+
+	if d.err != nil {
+		return URLResult{}, d.err
+	}
+	if len(d.buf) != 0 {
+		return URLResult{}, fmt.Errorf("%w: %d trailing bytes", errCacheCorrupt, len(d.buf))
+	}
+	return result, nil
+}
+
+type cacheEncoder struct {
+	buf []byte
+}
+
+func (e *cacheEncoder) uvarint(v uint64) { e.buf = binary.AppendUvarint(e.buf, v) }
+func (e *cacheEncoder) varint(v int64)   { e.buf = binary.AppendVarint(e.buf, v) }
+
+func (e *cacheEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cacheEncoder) bool(b bool) {
+	if b {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// time keeps the zero time distinct from the Unix epoch
+func (e *cacheEncoder) time(t time.Time) {
+	if t.IsZero() {
+		e.varint(math.MinInt64)
+		return
+	}
+	e.varint(t.UnixNano())
+}
+
+// cacheDecoder reads fields in order and remembers the first error, so Decode
+// can read everything and check once at the end
+type cacheDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *cacheDecoder) fail() {
+	if d.err == nil {
+		d.err = errCacheCorrupt
+	}
+	d.buf = nil
+}
+
+func (d *cacheDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *cacheDecoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads a slice length, rejecting lengths the remaining bytes can't hold
+func (d *cacheDecoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *cacheDecoder) string() string {
+	n := d.count()
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *cacheDecoder) bool() bool {
+	if len(d.buf) == 0 {
+		d.fail()
+		return false
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	if b > 1 {
+		d.fail()
+	}
+	return b == 1
+}
+
+func (d *cacheDecoder) time() time.Time {
+	v := d.varint()
+	if v == math.MinInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Round-trip tests plus size/speed benchmarks for the L2 encoding:
+//   go test -v cache_codec_test.go cache_codec.go common.go
+//   go test -bench . -run '^$' cache_codec_test.go cache_codec.go common.go
+
+var (
+	plainCodec      = CacheCodec{}
+	compressedCodec = CacheCodec{Compress: true, CompressMin: 0}
+)
+
+func sampleResults() map[string]URLResult {
+	checkedAt := time.Now().Round(0)
+	return map[string]URLResult{
+		"plain": {
+			URL:       "https://example.com/status",
+			Status:    200,
+			Duration:  87,
+			CheckedAt: checkedAt,
+			WorkerID:  "worker-1",
+			Protocol:  "h2",
+		},
+		"error": {
+			URL:       "https://down.example.org/",
+			Error:     "dial tcp 203.0.113.7:443: i/o timeout",
+			Duration:  5000,
+			CheckedAt: checkedAt,
+			WorkerID:  "worker-2",
+			Region:    "eu-west",
+		},
+		"full": {
+			CheckID:   "run-1700000000:42",
+			URL:       "https://shop.example.com/checkout?session=abc",
+			Status:    200,
+			Duration:  143,
+			CheckedAt: checkedAt,
+			WorkerID:  "worker-3",
+			Region:    "us-east",
+			Protocol:  "h2",
+			SecurityAudit: &SecurityAudit{
+				Score:     65,
+				AuditedAt: checkedAt,
+				Findings: []SecurityFinding{
+					{Check: "hsts", Severity: "high", Message: "Strict-Transport-Security header missing"},
+					{Check: "csp", Severity: "medium", Message: "Content-Security-Policy header missing"},
+					{Check: "cookie_samesite", Severity: "low", Message: "cookie \"session\" has no SameSite attribute"},
+				},
+			},
+			Families: []FamilyResult{
+				{Family: "ipv4", Status: 200, Duration: 120, Protocol: "h2", RemoteAddr: "93.184.216.34:443"},
+				{Family: "ipv6", Error: "connect: network is unreachable", Duration: 3},
+			},
+			PartialOutage: true,
+		},
+	}
+}
+
+func TestCacheCodecRoundTrip(t *testing.T) {
+	samples := sampleResults()
+	for _, name := range []string{"plain", "error", "full"} {
+		want := samples[name]
+		for _, codec := range []CacheCodec{plainCodec, compressedCodec} {
+			got, err := codec.Decode(codec.Encode(want))
+			if err != nil || !sameCachedResult(got, want) {
+				t.Errorf("%s (compress=%v): got %+v, %v", name, codec.Compress, got, err)
+			}
+		}
+	}
+}
+
+func TestCacheCodecSkipsServingFields(t *testing.T) {
+	r := sampleResults()["plain"]
+	r.ServedBy, r.AgeMs = "l1", 1234
+	got, _ := plainCodec.Decode(plainCodec.Encode(r))
+	if got.ServedBy != "" || got.AgeMs != 0 {
+		t.Errorf("served_by=%q age_ms=%d stored", got.ServedBy, got.AgeMs)
+	}
+}
+
+// Old and foreign entries are misses, not zero values
+func TestCacheCodecRejectsOtherVersions(t *testing.T) {
+	plain := sampleResults()["plain"]
+	oldJSON, _ := json.Marshal(plain)
+	future := plainCodec.Encode(plain)
+	future[1] = cacheFormatVersion + 1
+
+	for name, data := range map[string][]byte{"JSON entry": oldJSON, "future version": future, "empty entry": nil} {
+		if _, err := plainCodec.Decode(data); !errors.Is(err, errCacheVersion) {
+			t.Errorf("%s: got %v, want errCacheVersion", name, err)
+		}
+	}
+}
+
+func TestCacheCodecRejectsCorruptEntries(t *testing.T) {
+	full := sampleResults()["full"]
+	for _, codec := range []CacheCodec{plainCodec, compressedCodec} {
+		data := codec.Encode(full)
+		for cut := 3; cut < len(data); cut++ {
+			if _, err := codec.Decode(data[:cut]); err == nil {
+				t.Errorf("compress=%v: entry cut at %d/%d bytes decoded", codec.Compress, cut, len(data))
+			}
+		}
+
+		trailing := append(append([]byte{}, data...), 0)
+		if _, err := codec.Decode(trailing); !errors.Is(err, errCacheCorrupt) {
+			t.Errorf("compress=%v: trailing bytes got %v, want errCacheCorrupt", codec.Compress, err)
+		}
+	}
+
+	flags := plainCodec.Encode(sampleResults()["plain"])
+	flags[2] = 0x80
+	if _, err := plainCodec.Decode(flags); !errors.Is(err, errCacheCorrupt) {
+		t.Errorf("unknown flags got %v, want errCacheCorrupt", err)
+	}
+}
+
+// Run with -v to see the size table
+func TestCacheCodecSmallerThanJSON(t *testing.T) {
+	samples := sampleResults()
+	t.Logf("%-8s %8s %8s %10s %8s", "sample", "json", "binary", "bin+flate", "saved")
+	for _, name := range []string{"plain", "error", "full"} {
+		r := samples[name]
+		j, _ := json.Marshal(r)
+		b := plainCodec.Encode(r)
+		c := compressedCodec.Encode(r)
+		best := min(len(b), len(c))
+		t.Logf("%-8s %7dB %7dB %9dB %7.0f%%", name, len(j), len(b), len(c), 100*(1-float64(best)/float64(len(j))))
+		if len(b) >= len(j) {
+			t.Errorf("%s: binary %dB not smaller than JSON %dB", name, len(b), len(j))
+		}
+	}
+}
+
+func BenchmarkCacheCodec(b *testing.B) {
+	full := sampleResults()["full"]
+	fullJSON, _ := json.Marshal(full)
+	fullBin := plainCodec.Encode(full)
+	fullFlate := compressedCodec.Encode(full)
+
+	for _, bm := range []struct {
+		name string
+		fn   func()
+	}{
+		{"json encode", func() { json.Marshal(full) }},
+		{"json decode", func() {
+			var r URLResult
+			json.Unmarshal(fullJSON, &r)
+		}},
+		{"binary encode", func() { plainCodec.Encode(full) }},
+		{"binary decode", func() { plainCodec.Decode(fullBin) }},
+		{"flate encode", func() { compressedCodec.Encode(full) }},
+		{"flate decode", func() { compressedCodec.Decode(fullFlate) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bm.fn()
+			}
+		})
+	}
+}
+
+// sameCachedResult compares what L2 stores; times are compared as instants
+func sameCachedResult(a, b URLResult) bool {
+	if !a.CheckedAt.Equal(b.CheckedAt) {
+		return false
+	}
+	if (a.SecurityAudit == nil) != (b.SecurityAudit == nil) {
+		return false
+	}
+	if a.SecurityAudit != nil {
+		if !a.SecurityAudit.AuditedAt.Equal(b.SecurityAudit.AuditedAt) {
+			return false
+		}
+		sa, sb := *a.SecurityAudit, *b.SecurityAudit
+		sa.AuditedAt, sb.AuditedAt = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(sa, sb) {
+			return false
+		}
+	}
+	a.CheckedAt, b.CheckedAt = time.Time{}, time.Time{}
+	a.SecurityAudit, b.SecurityAudit = nil, nil
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Workers subscribe to this channel and evict matching L1 entries
+const cacheInvalidationChannel = "cache:invalidate"
+
+type CacheInvalidation struct {
+	URL    string `json:"url,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (inv CacheInvalidation) Matches(url string) bool {
+	if inv.URL != "" {
+		return url == inv.URL
+	}
+	return inv.Prefix != "" && strings.HasPrefix(url, inv.Prefix)
+}
+
+// CacheKey returns the L2 key for a URL. Results are kept per region so a
+// check targeted at one location is never answered from another's fetch.
+func CacheKey(region, url string) string {
+	if region == "" || region == defaultRegion {
+		return fmt.Sprintf("cache:%s", url)
+	}
+	return fmt.Sprintf("cache:%s:%s", region, url)
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// checkPurgePrefix makes sure a prefix names at least one whole host, so a
+// typo like "h" or "https://" can't empty the cache of every target
+func checkPurgePrefix(prefix string) error {
+	u, err := url.Parse(prefix)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("purge prefix %q must include the scheme, the whole host and a path, like https://example.com/", prefix)
+	}
+	return nil
+}
+
+// PurgeCache deletes a URL (or every URL under a prefix) from L2 in all
+// regions, then broadcasts so every worker drops it from L1 too.
+func PurgeCache(ctx context.Context, rdb *redis.Client, inv CacheInvalidation) (int64, error) {
+	if inv.URL == "" && inv.Prefix == "" {
+		return 0, fmt.Errorf("purge needs a url or a prefix")
+	}
+	if inv.URL == "" {
+		if err := checkPurgePrefix(inv.Prefix); err != nil {
+			return 0, err
+		}
+	}
+
+	regions := map[string]bool{defaultRegion: true}
+	for _, region := range GetRegions(rdb) {
+		regions[region] = true
+	}
+
+	var keys []string
+	for region := range regions {
+		if inv.URL != "" {
+			keys = append(keys, CacheKey(region, inv.URL))
+			continue
+		}
+
+		pattern := CacheKey(region, globEscaper.Replace(inv.Prefix)) + "*"
+		iter := rdb.Scan(ctx, 0, pattern, 500).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	var deleted int64
+	for start := 0; start < len(keys); start += 500 {
+		end := min(start+500, len(keys))
+		n, err := rdb.Del(ctx, keys[start:end]...).Result()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	data, _ := json.Marshal(inv)
+	if err := rdb.Publish(ctx, cacheInvalidationChannel, data).Err(); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// RefreshCache purges a URL and enqueues an origin check for it in every
+// region, so the next cached value is fresh everywhere.
+func RefreshCache(ctx context.Context, rdb *redis.Client, url string) (int64, error) {
+	deleted, err := PurgeCache(ctx, rdb, CacheInvalidation{URL: url})
+	if err != nil {
+		return deleted, err
+	}
+
+	regions := GetRegions(rdb)
+	if len(regions) == 0 {
+		regions = []string{defaultRegion}
+	}
+
+	// RPUSH puts it at the end workers BRPOP from, ahead of the backlog
+	item := QueueItem{URL: url, Freshness: Freshness{Mode: FreshnessOrigin}}
+	for _, region := range regions {
+		if err := rdb.RPush(ctx, QueueKey(region), item.Encode()).Err(); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
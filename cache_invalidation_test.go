@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+// Run with:
+//   go test cache_invalidation_test.go cache_invalidation.go common.go
+
+func TestPurgePrefixNamesAHost(t *testing.T) {
+	for prefix, ok := range map[string]bool{
+		"https://example.com/":          true,
+		"http://example.com/blog/":      true,
+		"https://shop.example.com/cart": true,
+		"":                              false,
+		"h":                             false,
+		"https://":                      false,
+		"https://e":                     false,
+		"https://example.com":           false, // also https://example.com.evil.org
+		"example.com/":                  false,
+		"ftp://example.com/":            false,
+	} {
+		if err := checkPurgePrefix(prefix); (err == nil) != ok {
+			t.Errorf("prefix %q: got %v, want accepted=%v", prefix, err, ok)
+		}
+	}
+}
@@ -3,76 +3,461 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/redis/go-redis/v9"
 )
 
-type cacheEntry struct {
-	result    URLResult
-	timestamp time.Time
+// RuleStats counts lookups per cache policy rule so TTLs can be tuned. Hits
+// has one counter per tier, fastest first.
+type RuleStats struct {
+	Hits        []int64
+	Misses      int64
+	StaleServes int64
+}
+
+// Implemented by local tiers that can drop entries purged elsewhere
+type invalidator interface {
+	Invalidate(inv CacheInvalidation) int
+}
+
+// Implemented by tiers that count hits per entry
+type hotKeyer interface {
+	HotKeys(n int) map[string]int64
+}
+
+// Implemented by tiers with a bounded size
+type evictionCounter interface {
+	Evictions() (evicted, removed int64)
 }
 
 type CacheManager struct {
-	l1       *lru.Cache[string, cacheEntry]
-	l2       *redis.Client
-	stampede *StampedePreventer
+	tiers    []ChainedTier
+	labels   []string // "l1", "l2", ... as reported in ServedBy
+	stampede *SingleFlight[string, URLResult]
+	policy   CachePolicy
+
+	// distributed coalesces origin fetches across workers through the first
+	// shared tier that is filled from origin; nil disables it
+	distributed *DistributedStampede
+	sharedFill  int
+
+	// URLs with a background refresh running
+	refreshing sync.Map
 
 	//Metrics (use atomic for concurrency safety)
-	l1Hits int64
-	l2Hits int64
-	origin int64
+	hits         []int64 // per tier
+	misses       []int64 // per tier
+	errors       []int64 // per tier
+	origin       int64
+	staleServes  int64
+	refreshAhead int64
+	decodeErrors int64
+	ruleStats    map[string]*RuleStats // fixed at construction, counters are atomic
+
+	latency map[string]*LatencyHistogram // per tier label and "origin", fixed at construction
+	domains *domainCounter
 }
 
-func NewCacheManager(l1Size int, redisClient *redis.Client, stampede *StampedePreventer) (*CacheManager, error) {
-	l1Cache, err := lru.New[string, cacheEntry](l1Size)
-	if err != nil {
-		return nil, err
+func NewCacheManager(policy CachePolicy, tiers []ChainedTier, stampede *SingleFlight[string, URLResult], distributed *DistributedStampede) (*CacheManager, error) {
+	cm := &CacheManager{
+		tiers:      tiers,
+		stampede:   stampede,
+		policy:     policy,
+		sharedFill: -1,
+		hits:       make([]int64, len(tiers)),
+		misses:     make([]int64, len(tiers)),
+		errors:     make([]int64, len(tiers)),
+		ruleStats:  make(map[string]*RuleStats),
+		latency:    map[string]*LatencyHistogram{"origin": NewLatencyHistogram()},
+		domains:    newDomainCounter(),
+	}
+
+	for i, tier := range tiers {
+		label := fmt.Sprintf("l%d", i+1)
+		cm.labels = append(cm.labels, label)
+		cm.latency[label] = NewLatencyHistogram()
+		if cm.sharedFill < 0 && tier.Shared() && tier.Policy.Fill {
+			cm.sharedFill = i
+		}
+	}
+
+	if distributed != nil && cm.sharedFill < 0 {
+		return nil, errors.New("distributed stampede needs a shared cache tier filled from origin")
 	}
-	return &CacheManager{l1: l1Cache, l2: redisClient, stampede: stampede}, nil
+	cm.distributed = distributed
+
+	for _, rule := range policy.Rules() {
+		cm.ruleStats[rule.Name] = &RuleStats{Hits: make([]int64, len(tiers))}
+	}
+
+	return cm, nil
 }
 
-func (cm *CacheManager) Get(ctx context.Context, url string, fetchFunc func(string) URLResult) URLResult {
-	//Check L1 cache (in-memory)
-	entry, ok := cm.l1.Get(url)
-	if ok {
-		if time.Since(entry.timestamp) < 60*time.Second {
-			atomic.AddInt64(&cm.l1Hits, 1)
-			return entry.result
-		} else {
-			cm.l1.Remove(url)
+// Get returns the result for url from the first tier that satisfies the
+// freshness requirement, fetching from origin otherwise. The returned result
+// records which tier served it and how old its data was.
+func (cm *CacheManager) Get(ctx context.Context, url string, freshness Freshness, fetchFunc func(string) URLResult) URLResult {
+	result := cm.get(ctx, url, freshness, fetchFunc)
+	cm.domains.Record(url, result.ServedBy != "" && result.ServedBy != "origin")
+	return result
+}
+
+func (cm *CacheManager) get(ctx context.Context, url string, freshness Freshness, fetchFunc func(string) URLResult) URLResult {
+	if freshness.Mode == FreshnessOrigin {
+		return cm.load(ctx, url, freshness, fetchFunc)
+	}
+
+	// An entry past its TTL but inside the stale-while-revalidate window is
+	// only served if no lower tier has a fresh one
+	stale := -1
+	var staleEntry TierEntry
+
+	for i, tier := range cm.tiers {
+		entry, ok := cm.lookup(ctx, i, url)
+		if !ok {
+			continue
+		}
+
+		rule := cm.policy.RuleFor(entry.Result)
+		ttl := tier.Policy.TTL(rule)
+		age := time.Since(entry.StoredAt)
+
+		if usable(entry, age, ttl, rule.StaleWhileRevalidate, freshness) {
+			atomic.AddInt64(&cm.hits[i], 1)
+			atomic.AddInt64(&cm.ruleStats[rule.Name].Hits[i], 1)
+
+			// Refresh hot keys before they expire so callers never pay origin latency
+			if ahead := rule.RefreshAhead; ahead > 0 && entry.Hits >= int64(rule.HotHits) &&
+				age >= time.Duration(float64(ttl)*ahead) && age < ttl {
+				if cm.revalidate(url, fetchFunc) {
+					atomic.AddInt64(&cm.refreshAhead, 1)
+				}
+			}
+
+			cm.promote(ctx, i, url, entry.Result)
+			return served(entry.Result, cm.labels[i])
 		}
+
+		if stale < 0 && freshness.Mode == FreshnessDefault && age < ttl+rule.StaleWhileRevalidate {
+			stale, staleEntry = i, entry
+		}
+	}
+
+	// Stale-while-revalidate: serve the old value, refresh in the background
+	if stale >= 0 {
+		rule := cm.policy.RuleFor(staleEntry.Result)
+		atomic.AddInt64(&cm.staleServes, 1)
+		atomic.AddInt64(&cm.ruleStats[rule.Name].StaleServes, 1)
+		cm.revalidate(url, fetchFunc)
+		return served(staleEntry.Result, cm.labels[stale]+"-stale")
+	}
+
+	return cm.load(ctx, url, freshness, fetchFunc)
+}
+
+// lookup reads one tier, timing it and classifying failures. Entries that
+// don't decode (corrupt, or written in another format version) are misses,
+// counted separately so a rollout or a bad writer shows up instead of
+// silently serving zero values.
+func (cm *CacheManager) lookup(ctx context.Context, i int, url string) (TierEntry, bool) {
+	start := time.Now()
+	entry, err := cm.tiers[i].Lookup(ctx, url)
+	cm.latency[cm.labels[i]].Observe(time.Since(start))
+
+	switch {
+	case err == nil:
+		return entry, true
+	case errors.Is(err, errCacheMiss):
+		atomic.AddInt64(&cm.misses[i], 1)
+	case errors.Is(err, errCacheVersion) || errors.Is(err, errCacheCorrupt):
+		if atomic.AddInt64(&cm.decodeErrors, 1) == 1 {
+			log.Printf("⚠️ Undecodable %s entry for %s: %v\n", cm.tiers[i].Kind(), url, err)
+		}
+	default:
+		if atomic.AddInt64(&cm.errors[i], 1) == 1 {
+			log.Printf("⚠️ %s lookup failed for %s: %v\n", cm.tiers[i].Kind(), url, err)
+		}
+	}
+	return TierEntry{}, false
+}
+
+// usable reports whether a tier entry satisfies freshness. stale-ok still
+// stops at the end of the stale-while-revalidate window: tiers that keep
+// entries longer (postgres keeps every check) would otherwise serve data of
+// any age.
+func usable(entry TierEntry, age, ttl, swr time.Duration, freshness Freshness) bool {
+	switch freshness.Mode {
+	case FreshnessStaleOK:
+		return age < ttl+swr
+	case FreshnessMaxAge:
+		return freshness.Accepts(time.Since(entry.Result.CheckedAt))
 	}
+	return age < ttl
+}
 
-	//Check L2 cache (Redis)
-	cacheKey := fmt.Sprintf("cache:%s", url)
-	cache, err := cm.l2.Get(ctx, cacheKey).Bytes()
-	if err == nil {
-		atomic.AddInt64(&cm.l2Hits, 1)
-		cacheRes := URLResult{}
-		json.Unmarshal(cache, &cacheRes)
+// promote copies a hit from tier i into the faster tiers that take promotions
+func (cm *CacheManager) promote(ctx context.Context, i int, url string, result URLResult) {
+	rule := cm.policy.RuleFor(result)
+	for _, tier := range cm.tiers[:i] {
+		if ttl := tier.Policy.TTL(rule); tier.Policy.Promote && ttl > 0 {
+			tier.Store(ctx, url, result, ttl+rule.StaleWhileRevalidate)
+		}
+	}
+}
 
-		if cacheRes.Status == 200 {
-			cm.l1.Add(url, cacheEntry{cacheRes, time.Now()})
+// store writes an origin result into the tiers that are filled from origin,
+// shared or local
+func (cm *CacheManager) store(ctx context.Context, url string, result URLResult, shared bool) {
+	rule := cm.policy.RuleFor(result)
+	for _, tier := range cm.tiers {
+		if ttl := tier.Policy.TTL(rule); tier.Policy.Fill && tier.Shared() == shared && ttl > 0 {
+			tier.Store(ctx, url, result, ttl+rule.StaleWhileRevalidate)
 		}
+	}
+}
 
-		return cacheRes
+// revalidate refreshes a URL in the background, at most once at a time. The
+// refresh goes through the single-flight like any miss.
+func (cm *CacheManager) revalidate(url string, fetchFunc func(string) URLResult) bool {
+	if _, running := cm.refreshing.LoadOrStore(url, struct{}{}); running {
+		return false
+	}
+
+	go func() {
+		defer cm.refreshing.Delete(url)
+		cm.load(context.Background(), url, Freshness{Mode: FreshnessOrigin}, fetchFunc)
+	}()
+	return true
+}
+
+// load fetches a missing key: one fetch per process, and one per cluster when
+// distributed. The result is stored in every tier according to the policy.
+func (cm *CacheManager) load(ctx context.Context, url string, freshness Freshness, fetchFunc func(string) URLResult) URLResult {
+	start := time.Now()
+	result, _, err := cm.stampede.Do(ctx, url, func(fctx context.Context) (URLResult, error) {
+		if cm.distributed == nil {
+			return cm.fetchAndStore(fctx, url, fetchFunc), nil
+		}
+
+		cacheKey := CacheKey(cm.distributedRegion(), url)
+		lookup := func(since time.Time) (URLResult, bool) {
+			return cm.lookupFilled(fctx, url, freshness, since)
+		}
+		res, coalesced := cm.distributed.Fetch(fctx, cacheKey, lookup, func() URLResult {
+			return cm.fetchAndStore(fctx, url, fetchFunc)
+		})
+		if coalesced {
+			// Marks the shared result for every local caller; stamped below
+			res.ServedBy = cm.labels[cm.sharedFill]
+		}
+		return res, nil
+	})
+	if err != nil {
+		// This caller gave up; the fetch carries on for anyone still waiting
+		return URLResult{URL: url, Error: err.Error(), CheckedAt: start}
+	}
+
+	cm.store(ctx, url, result, false)
+
+	rule := cm.policy.RuleFor(result)
+	if cm.sharedFill >= 0 && result.ServedBy == cm.labels[cm.sharedFill] {
+		atomic.AddInt64(&cm.hits[cm.sharedFill], 1)
+		atomic.AddInt64(&cm.ruleStats[rule.Name].Hits[cm.sharedFill], 1)
+		return served(result, result.ServedBy)
 	}
 
-	//Fetch URL
-	result := stampede.Fetch(url, fetchFunc)
 	atomic.AddInt64(&cm.origin, 1)
-	if result.Status == 200 {
-		cm.l1.Add(url, cacheEntry{result, time.Now()})
+	atomic.AddInt64(&cm.ruleStats[rule.Name].Misses, 1)
+	return served(result, "origin")
+}
+
+// distributedRegion scopes lease keys like the shared tier's cache keys
+func (cm *CacheManager) distributedRegion() string {
+	if tier, ok := cm.tiers[cm.sharedFill].CacheTier.(*RedisTier); ok {
+		return tier.region
+	}
+	return defaultRegion
+}
+
+// fetchAndStore hits origin and writes the shared tiers before returning, so
+// workers waiting on the distributed lease find the value as soon as it's
+// released.
+func (cm *CacheManager) fetchAndStore(ctx context.Context, url string, fetchFunc func(string) URLResult) URLResult {
+	start := time.Now()
+	result := fetchFunc(url)
+	cm.latency["origin"].Observe(time.Since(start))
+	cm.store(ctx, url, result, true)
+	return result
+}
+
+// lookupFilled checks whether another worker filled the shared tier while we
+// waited. A must-hit-origin caller only accepts the value written by the
+// fetch it waits on, which started at since.
+func (cm *CacheManager) lookupFilled(ctx context.Context, url string, freshness Freshness, since time.Time) (URLResult, bool) {
+	// Polled while waiting, so not counted as lookups
+	entry, err := cm.tiers[cm.sharedFill].Lookup(ctx, url)
+	if err != nil {
+		return URLResult{}, false
+	}
+	result := entry.Result
+
+	if freshness.Mode == FreshnessOrigin {
+		return result, !result.CheckedAt.Before(since)
+	}
+	return result, freshness.Accepts(time.Since(result.CheckedAt))
+}
+
+// served stamps the serving tier and data age on a copy of a cached result
+func served(result URLResult, tier string) URLResult {
+	result.ServedBy = tier
+	result.AgeMs = 0
+	if tier != "origin" {
+		result.AgeMs = time.Since(result.CheckedAt).Milliseconds()
 	}
-	resultByte, _ := json.Marshal(result)
-	cm.l2.Set(ctx, cacheKey, resultByte, 5*time.Minute)
 	return result
 }
 
-func (cm *CacheManager) GetStats() (l1Hits, l2Hits, originFetch int64) {
-	return atomic.LoadInt64(&cm.l1Hits), atomic.LoadInt64(&cm.l2Hits), atomic.LoadInt64(&cm.origin)
+// Tiers describes the chain, fastest first, as "l1=memory" etc.
+func (cm *CacheManager) Tiers() []string {
+	names := make([]string, len(cm.tiers))
+	for i, tier := range cm.tiers {
+		names[i] = cm.labels[i] + "=" + tier.Kind()
+	}
+	return names
+}
+
+// GetStampedeStats reports origin loads that actually ran versus callers
+// that asked for one; the difference was de-duplicated in this process.
+func (cm *CacheManager) GetStampedeStats() (flights, callers int64) {
+	return cm.stampede.Stats()
+}
+
+// GetRefreshStats reports stale-while-revalidate serves and refresh-ahead fetches
+func (cm *CacheManager) GetRefreshStats() (staleServes, refreshAhead int64) {
+	return atomic.LoadInt64(&cm.staleServes), atomic.LoadInt64(&cm.refreshAhead)
+}
+
+// GetDecodeErrors reports cache entries that were treated as misses because
+// they didn't decode
+func (cm *CacheManager) GetDecodeErrors() int64 {
+	return atomic.LoadInt64(&cm.decodeErrors)
+}
+
+// HotKeys returns the hit counts of the n most-hit entries of the first tier
+// that tracks them
+func (cm *CacheManager) HotKeys(n int) map[string]int64 {
+	for _, tier := range cm.tiers {
+		if h, ok := tier.CacheTier.(hotKeyer); ok {
+			return h.HotKeys(n)
+		}
+	}
+	return nil
+}
+
+// Preload copies the given URLs from the lower tiers into the first one, as
+// a first lookup would, and returns how many were loaded
+func (cm *CacheManager) Preload(ctx context.Context, urls []string) int {
+	if len(cm.tiers) < 2 {
+		return 0
+	}
+
+	loaded := 0
+	for _, url := range urls {
+		for i := 1; i < len(cm.tiers); i++ {
+			entry, err := cm.tiers[i].Lookup(ctx, url)
+			if err != nil {
+				continue
+			}
+			if ttl := cm.tiers[0].Policy.TTL(cm.policy.RuleFor(entry.Result)); ttl > 0 {
+				cm.promote(ctx, i, url, entry.Result)
+				loaded++
+			}
+			break
+		}
+	}
+	return loaded
+}
+
+// Metrics snapshots every counter and latency histogram for publishing
+func (cm *CacheManager) Metrics(workerID string) CacheMetrics {
+	m := CacheMetrics{
+		WorkerID:     workerID,
+		UpdatedAt:    time.Now(),
+		Tiers:        cm.Tiers(),
+		Hits:         make(map[string]int64, len(cm.tiers)),
+		Misses:       make(map[string]int64, len(cm.tiers)),
+		Errors:       make(map[string]int64, len(cm.tiers)),
+		StaleServes:  atomic.LoadInt64(&cm.staleServes),
+		Origin:       atomic.LoadInt64(&cm.origin),
+		DecodeErrors: atomic.LoadInt64(&cm.decodeErrors),
+		Latency:      make(map[string]HistogramSnapshot, len(cm.latency)),
+		Domains:      cm.domains.Snapshot(),
+	}
+	for i, tier := range cm.tiers {
+		label := cm.labels[i]
+		m.Hits[label] = atomic.LoadInt64(&cm.hits[i])
+		m.Misses[label] = atomic.LoadInt64(&cm.misses[i])
+		m.Errors[label] = atomic.LoadInt64(&cm.errors[i])
+		if ec, ok := tier.CacheTier.(evictionCounter); ok {
+			evicted, removed := ec.Evictions()
+			m.Evictions += evicted
+			m.Removals += removed
+		}
+	}
+	for tier, h := range cm.latency {
+		m.Latency[tier] = h.Snapshot()
+	}
+	return m
+}
+
+func (cm *CacheManager) GetRuleStats() map[string]RuleStats {
+	stats := make(map[string]RuleStats, len(cm.ruleStats))
+	for name, s := range cm.ruleStats {
+		hits := make([]int64, len(s.Hits))
+		for i := range s.Hits {
+			hits[i] = atomic.LoadInt64(&s.Hits[i])
+		}
+		stats[name] = RuleStats{
+			Hits:        hits,
+			Misses:      atomic.LoadInt64(&s.Misses),
+			StaleServes: atomic.LoadInt64(&s.StaleServes),
+		}
+	}
+	return stats
+}
+
+// Invalidate evicts matching entries from the local tiers and returns how
+// many were dropped. Shared tiers are purged once, by whoever broadcast it.
+func (cm *CacheManager) Invalidate(inv CacheInvalidation) int {
+	removed := 0
+	for _, tier := range cm.tiers {
+		if local, ok := tier.CacheTier.(invalidator); ok && !tier.Shared() {
+			removed += local.Invalidate(inv)
+		}
+	}
+	return removed
+}
+
+// ListenForInvalidations evicts local entries purged or refreshed elsewhere,
+// so a worker never serves a value for up to the L1 TTL after L2 changed.
+func (cm *CacheManager) ListenForInvalidations(ctx context.Context, rdb *redis.Client) {
+	pubsub := rdb.Subscribe(ctx, cacheInvalidationChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var inv CacheInvalidation
+		if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+			log.Printf("⚠️ Ignoring malformed cache invalidation: %v\n", err)
+			continue
+		}
+		if removed := cm.Invalidate(inv); removed > 0 {
+			log.Printf("🧹 Invalidated %d local cache entries (%+v)\n", removed, inv)
+		}
+	}
 }
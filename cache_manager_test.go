@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Run with:
+//   go test cache_manager_test.go cache_manager.go distributed_stampede.go cache_tier.go cache_policy.go cache_codec.go cache_metrics.go cache_invalidation.go cache_warmup.go stampede.go latency_tracker.go db_manager.go result_envelope.go result_sink.go check_store.go mongo_model.go config.go common.go
+//
+// The postgres tier case uses LEADER_DSN, and is skipped when that server
+// isn't reachable.
+
+func TestUsableBoundsStaleOK(t *testing.T) {
+	const ttl, swr = time.Minute, 30 * time.Second
+	staleOK := Freshness{Mode: FreshnessStaleOK}
+
+	tests := []struct {
+		name      string
+		age       time.Duration
+		freshness Freshness
+		want      bool
+	}{
+		{"fresh", 30 * time.Second, Freshness{}, true},
+		{"expired", 70 * time.Second, Freshness{}, false},
+		{"stale-ok inside the SWR window", 80 * time.Second, staleOK, true},
+		{"stale-ok past the SWR window", 2 * time.Minute, staleOK, false},
+		// A postgres row keeps the last check indefinitely
+		{"stale-ok on a day-old row", 24 * time.Hour, staleOK, false},
+		{"max-age within", 50 * time.Second, Freshness{Mode: FreshnessMaxAge, MaxAge: 60}, true},
+		{"max-age past", 2 * time.Minute, Freshness{Mode: FreshnessMaxAge, MaxAge: 60}, false},
+	}
+	for _, tt := range tests {
+		now := time.Now()
+		entry := TierEntry{
+			Result:   URLResult{URL: "https://example.com/", CheckedAt: now.Add(-tt.age)},
+			StoredAt: now.Add(-tt.age),
+		}
+		if got := usable(entry, tt.age, ttl, swr, tt.freshness); got != tt.want {
+			t.Errorf("%s: usable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPostgresTierOnlyAnswersForItsRegion(t *testing.T) {
+	config := LoadConfig()
+	db, err := NewDBManager(config.LeaderDSN, config.FollowerDSN)
+	if err != nil {
+		t.Skipf("no Postgres: %v", err)
+	}
+	defer db.Close()
+	pingCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := db.writeDB.PingContext(pingCtx); err != nil {
+		t.Skipf("no Postgres at LEADER_DSN: %v", err)
+	}
+
+	runID := fmt.Sprintf("run-test-%d", time.Now().UnixNano())
+	url := "https://example.com/tier?" + runID
+	check := URLResult{CheckID: runID + ":1", RunID: runID, Attempt: 1, URL: url, Status: 503,
+		Region: "eu-west", CheckedAt: time.Now().UTC()}
+	check.IdempotencyKey = IdempotencyKey(check)
+	if err := (&PostgresSink{db: db}).Write(context.Background(), []URLResult{check}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), `DELETE FROM checks WHERE run_id = $1`, runID)
+		db.Exec(context.Background(), `DELETE FROM urls WHERE url = $1`, url)
+	})
+
+	ctx := EnableReadYourWrites(context.Background())
+	entry, err := NewPostgresTier(db, "eu-west").Lookup(ctx, url)
+	if err != nil || entry.Result.Status != 503 || entry.Result.Region != "eu-west" {
+		t.Errorf("eu-west lookup = %+v, %v; want its own check", entry.Result, err)
+	}
+	for _, region := range []string{"us-east", ""} {
+		if _, err := NewPostgresTier(db, region).Lookup(ctx, url); !errors.Is(err, errCacheMiss) {
+			t.Errorf("region %q lookup = %v, want a miss for eu-west's check", region, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Workers publish a snapshot of their cache metrics here (one field per
+// worker); the monitor merges the fresh ones.
+const cacheMetricsKey = "cache:metrics"
+
+// How often workers publish, and how long the monitor trusts a snapshot
+const (
+	cacheMetricsInterval = 5 * time.Second
+	cacheMetricsMaxAge   = 6 * cacheMetricsInterval
+)
+
+// Upper bounds of the latency buckets in µs, roughly 1-2-5 per decade. The
+// last bucket catches everything slower.
+var latencyBucketsUs = []int64{
+	1, 2, 5, 10, 20, 50, 100, 200, 500,
+	1_000, 2_000, 5_000, 10_000, 20_000, 50_000, 100_000, 200_000, 500_000,
+	1_000_000, 2_000_000, 5_000_000, math.MaxInt64,
+}
+
+// LatencyHistogram counts durations into fixed buckets. Observe is lock-free
+// so it can sit on the lookup path.
+type LatencyHistogram struct {
+	counts []int64
+	sumUs  int64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{counts: make([]int64, len(latencyBucketsUs))}
+}
+
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	us := d.Microseconds()
+	i := sort.Search(len(latencyBucketsUs), func(i int) bool { return latencyBucketsUs[i] >= us })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sumUs, us)
+}
+
+func (h *LatencyHistogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Counts: make([]int64, len(h.counts)), SumUs: atomic.LoadInt64(&h.sumUs)}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return s
+}
+
+// HistogramSnapshot is a point-in-time copy of a LatencyHistogram; bucket i
+// counts durations up to latencyBucketsUs[i].
+type HistogramSnapshot struct {
+	Counts []int64 `json:"counts"`
+	SumUs  int64   `json:"sum_us"`
+}
+
+func (s HistogramSnapshot) Count() int64 {
+	var n int64
+	for _, c := range s.Counts {
+		n += c
+	}
+	return n
+}
+
+func (s HistogramSnapshot) MeanUs() float64 {
+	n := s.Count()
+	if n == 0 {
+		return 0
+	}
+	return float64(s.SumUs) / float64(n)
+}
+
+// QuantileUs returns the upper bound of the bucket holding quantile q, so it
+// overestimates by at most one bucket. The open last bucket reports the mean.
+func (s HistogramSnapshot) QuantileUs(q float64) int64 {
+	n := s.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(n)))
+	var seen int64
+	for i, c := range s.Counts {
+		seen += c
+		if seen >= rank {
+			if i == len(latencyBucketsUs)-1 {
+				return int64(s.MeanUs())
+			}
+			return latencyBucketsUs[i]
+		}
+	}
+	return 0
+}
+
+func (s *HistogramSnapshot) Merge(other HistogramSnapshot) {
+	if len(s.Counts) < len(other.Counts) {
+		s.Counts = append(s.Counts, make([]int64, len(other.Counts)-len(s.Counts))...)
+	}
+	for i, c := range other.Counts {
+		s.Counts[i] += c
+	}
+	s.SumUs += other.SumUs
+}
+
+// formatMicros renders a latency with a unit that fits its size
+func formatMicros(us int64) string {
+	switch {
+	case us < 1_000:
+		return fmt.Sprintf("%dµs", us)
+	case us < 1_000_000:
+		return fmt.Sprintf("%.1fms", float64(us)/1_000)
+	}
+	return fmt.Sprintf("%.2fs", float64(us)/1_000_000)
+}
+
+type DomainStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func (d DomainStats) HitRatio() float64 {
+	if d.Hits+d.Misses == 0 {
+		return 0
+	}
+	return float64(d.Hits) / float64(d.Hits+d.Misses)
+}
+
+// Beyond this many domains, new ones are counted under "other" so a crawl
+// over millions of hosts can't grow the map without bound
+const maxTrackedDomains = 1000
+
+// domainCounter tracks cache hits and misses per host
+type domainCounter struct {
+	mu      sync.Mutex
+	domains map[string]*DomainStats
+}
+
+func newDomainCounter() *domainCounter {
+	return &domainCounter{domains: make(map[string]*DomainStats)}
+}
+
+func (dc *domainCounter) Record(rawURL string, hit bool) {
+	domain := "other"
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+		domain = strings.ToLower(u.Hostname())
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	s, ok := dc.domains[domain]
+	if !ok {
+		if len(dc.domains) >= maxTrackedDomains {
+			domain = "other"
+			s = dc.domains[domain]
+		}
+		if s == nil {
+			s = &DomainStats{}
+			dc.domains[domain] = s
+		}
+	}
+	if hit {
+		s.Hits++
+	} else {
+		s.Misses++
+	}
+}
+
+func (dc *domainCounter) Snapshot() map[string]DomainStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	out := make(map[string]DomainStats, len(dc.domains))
+	for domain, s := range dc.domains {
+		out[domain] = *s
+	}
+	return out
+}
+
+// TopDomains returns up to n domains with the most lookups
+func TopDomains(domains map[string]DomainStats, n int) []string {
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := domains[names[i]], domains[names[j]]
+		if a.Hits+a.Misses != b.Hits+b.Misses {
+			return a.Hits+a.Misses > b.Hits+b.Misses
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// CacheMetrics is what a worker publishes about its cache. Counters are
+// totals since the worker started; per-tier maps are keyed "l1", "l2", ...
+type CacheMetrics struct {
+	WorkerID  string    `json:"worker_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Tiers     []string  `json:"tiers"` // "l1=memory", "l2=redis", ...
+
+	Hits        map[string]int64 `json:"hits"`
+	StaleServes int64            `json:"stale_serves"`
+	Origin      int64            `json:"origin"`
+
+	// Misses are absent keys; Errors are failed lookups (Redis or Postgres
+	// down) and DecodeErrors entries that were present but unreadable
+	Misses       map[string]int64 `json:"misses"`
+	Errors       map[string]int64 `json:"errors"`
+	DecodeErrors int64            `json:"decode_errors"`
+
+	// Evictions are memory entries pushed out by capacity; Removals were
+	// dropped on purpose (expired or invalidated)
+	Evictions int64 `json:"evictions"`
+	Removals  int64 `json:"removals"`
+
+	// Lookup latency per tier, plus "origin"
+	Latency map[string]HistogramSnapshot `json:"latency"`
+	Domains map[string]DomainStats       `json:"domains,omitempty"`
+}
+
+// CacheHits sums hits over every tier, including stale serves
+func (m CacheMetrics) CacheHits() int64 {
+	total := m.StaleServes
+	for _, n := range m.Hits {
+		total += n
+	}
+	return total
+}
+
+// TotalErrors sums failed lookups over every tier
+func (m CacheMetrics) TotalErrors() int64 {
+	var total int64
+	for _, n := range m.Errors {
+		total += n
+	}
+	return total
+}
+
+// Only the busiest domains are published to keep snapshots small
+const publishedDomains = 50
+
+// PublishCacheMetrics stores a worker's snapshot for the monitor
+func PublishCacheMetrics(ctx context.Context, rdb *redis.Client, m CacheMetrics) error {
+	if len(m.Domains) > publishedDomains {
+		top := make(map[string]DomainStats, publishedDomains)
+		for _, name := range TopDomains(m.Domains, publishedDomains) {
+			top[name] = m.Domains[name]
+		}
+		m.Domains = top
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, cacheMetricsKey, m.WorkerID, data).Err()
+}
+
+// GetCacheMetrics merges the snapshots of workers that published within
+// maxAge, and reports how many that was. Stopped workers age out.
+func GetCacheMetrics(ctx context.Context, rdb *redis.Client, maxAge time.Duration) (CacheMetrics, int) {
+	total := CacheMetrics{
+		Hits:    make(map[string]int64),
+		Misses:  make(map[string]int64),
+		Errors:  make(map[string]int64),
+		Latency: make(map[string]HistogramSnapshot),
+		Domains: make(map[string]DomainStats),
+	}
+
+	snapshots, err := rdb.HGetAll(ctx, cacheMetricsKey).Result()
+	if err != nil {
+		return total, 0
+	}
+
+	workers := 0
+	for _, raw := range snapshots {
+		var m CacheMetrics
+		if err := json.Unmarshal([]byte(raw), &m); err != nil || time.Since(m.UpdatedAt) > maxAge {
+			continue
+		}
+		workers++
+
+		total.StaleServes += m.StaleServes
+		total.Origin += m.Origin
+		total.DecodeErrors += m.DecodeErrors
+		total.Evictions += m.Evictions
+		total.Removals += m.Removals
+		for tier, n := range m.Hits {
+			total.Hits[tier] += n
+		}
+		for tier, n := range m.Misses {
+			total.Misses[tier] += n
+		}
+		for tier, n := range m.Errors {
+			total.Errors[tier] += n
+		}
+		if len(m.Tiers) > len(total.Tiers) {
+			total.Tiers = m.Tiers
+		}
+		if m.UpdatedAt.After(total.UpdatedAt) {
+			total.UpdatedAt = m.UpdatedAt
+		}
+
+		for tier, h := range m.Latency {
+			merged := total.Latency[tier]
+			merged.Merge(h)
+			total.Latency[tier] = merged
+		}
+		for domain, d := range m.Domains {
+			merged := total.Domains[domain]
+			merged.Hits += d.Hits
+			merged.Misses += d.Misses
+			total.Domains[domain] = merged
+		}
+	}
+	return total, workers
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheRule decides how long a result stays in each tier. A zero TTL keeps
+// the result out of that tier.
+type CacheRule struct {
+	Name  string
+	L1TTL time.Duration
+	L2TTL time.Duration
+
+	// StaleWhileRevalidate serves an expired L1 entry for this long while a
+	// background refresh runs
+	StaleWhileRevalidate time.Duration
+
+	// RefreshAhead refreshes entries hit at least HotHits times once they are
+	// this fraction of the way to L1 expiry (0 disables)
+	RefreshAhead float64
+	HotHits      int
+}
+
+// CachePolicy maps a result to its CacheRule: a per-domain override wins,
+// then the status class, and transport errors use the negative-caching rule.
+type CachePolicy struct {
+	L1Size int
+	Codec  CacheCodec
+
+	classes map[int]CacheRule
+	errors  CacheRule
+	domains map[string]CacheRule
+}
+
+// NewCachePolicy builds the policy from AppConfig. Rules are written as
+// "l1/l2[/swr[/ahead[/hits]]]": TTLs and the stale-while-revalidate window
+// in seconds, then the refresh-ahead threshold in percent of the L1 TTL and
+// the hits that make a key hot, e.g. CACHE_TTL_2XX=60/300/30/80/5. Domain
+// overrides take the same form, as CACHE_DOMAIN_TTLS=example.com=10/60,
+// status.io=0/30. Missing trailing fields come from CACHE_SWR,
+// CACHE_REFRESH_AHEAD and CACHE_HOT_HITS.
+func NewCachePolicy(config AppConfig) (CachePolicy, error) {
+	p := CachePolicy{
+		L1Size: config.CacheL1Size,
+		Codec: CacheCodec{
+			Compress:    config.CacheCompress,
+			CompressMin: config.CacheCompressMin,
+		},
+		classes: make(map[int]CacheRule),
+		domains: make(map[string]CacheRule),
+	}
+
+	classTTLs := map[int]string{
+		2: config.CacheTTL2xx,
+		3: config.CacheTTL3xx,
+		4: config.CacheTTL4xx,
+		5: config.CacheTTL5xx,
+	}
+	for class, value := range classTTLs {
+		rule, err := parseCacheRule(fmt.Sprintf("%dxx", class), value, config)
+		if err != nil {
+			return p, err
+		}
+		p.classes[class] = rule
+	}
+
+	rule, err := parseCacheRule("error", config.CacheErrorTTL, config)
+	if err != nil {
+		return p, err
+	}
+	p.errors = rule
+
+	for _, entry := range config.CacheDomainTTLs {
+		domain, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return p, fmt.Errorf("invalid domain cache override %q", entry)
+		}
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		rule, err := parseCacheRule("domain:"+domain, value, config)
+		if err != nil {
+			return p, err
+		}
+		p.domains[domain] = rule
+	}
+
+	return p, nil
+}
+
+func parseCacheRule(name, value string, config AppConfig) (CacheRule, error) {
+	fields := strings.Split(value, "/")
+	if len(fields) == 1 {
+		// A single number applies to L2 only
+		fields = []string{"0", fields[0]}
+	}
+	defaults := []int{config.CacheSWR, config.CacheRefreshAhead, config.CacheHotHits}
+	if len(fields) < 2 || len(fields) > 2+len(defaults) {
+		return CacheRule{}, fmt.Errorf("invalid TTLs for cache rule %s: %q", name, value)
+	}
+	for _, n := range defaults[len(fields)-2:] {
+		fields = append(fields, strconv.Itoa(n))
+	}
+
+	var n [5]int // l1, l2, swr, ahead, hits
+	for i, field := range fields {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || v < 0 {
+			return CacheRule{}, fmt.Errorf("invalid TTLs for cache rule %s: %q", name, value)
+		}
+		n[i] = v
+	}
+	if n[3] > 100 {
+		return CacheRule{}, fmt.Errorf("refresh-ahead for cache rule %s is %d%%, past the L1 TTL", name, n[3])
+	}
+
+	return CacheRule{
+		Name:                 name,
+		L1TTL:                time.Duration(n[0]) * time.Second,
+		L2TTL:                time.Duration(n[1]) * time.Second,
+		StaleWhileRevalidate: time.Duration(n[2]) * time.Second,
+		RefreshAhead:         float64(n[3]) / 100,
+		HotHits:              n[4],
+	}, nil
+}
+
+// Rules lists every rule so stats can be broken down even before first use
+func (p CachePolicy) Rules() []CacheRule {
+	rules := []CacheRule{p.errors}
+	for class := 2; class <= 5; class++ {
+		rules = append(rules, p.classes[class])
+	}
+	for _, rule := range p.domains {
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// DomainRule returns the override for a URL's host or any parent domain
+func (p CachePolicy) DomainRule(rawURL string) (CacheRule, bool) {
+	if len(p.domains) == 0 {
+		return CacheRule{}, false
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return CacheRule{}, false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if rule, ok := p.domains[host]; ok {
+			return rule, true
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	return CacheRule{}, false
+}
+
+func (p CachePolicy) RuleFor(result URLResult) CacheRule {
+	if rule, ok := p.DomainRule(result.URL); ok {
+		return rule
+	}
+	if result.Status == 0 {
+		return p.errors
+	}
+	if rule, ok := p.classes[result.Status/100]; ok {
+		return rule
+	}
+	return p.errors
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Run with:
+//   go test cache_policy_test.go cache_policy.go cache_codec.go config.go common.go
+
+func TestParseCacheRule(t *testing.T) {
+	config := AppConfig{CacheSWR: 5, CacheRefreshAhead: 80, CacheHotHits: 10}
+	s := time.Second
+
+	for _, tc := range []struct {
+		value string
+		want  CacheRule
+	}{
+		{"300", CacheRule{L2TTL: 300 * s, StaleWhileRevalidate: 5 * s, RefreshAhead: 0.8, HotHits: 10}},
+		{"60/300", CacheRule{L1TTL: 60 * s, L2TTL: 300 * s, StaleWhileRevalidate: 5 * s, RefreshAhead: 0.8, HotHits: 10}},
+		{"60/300/30", CacheRule{L1TTL: 60 * s, L2TTL: 300 * s, StaleWhileRevalidate: 30 * s, RefreshAhead: 0.8, HotHits: 10}},
+		{"60/300/30/50", CacheRule{L1TTL: 60 * s, L2TTL: 300 * s, StaleWhileRevalidate: 30 * s, RefreshAhead: 0.5, HotHits: 10}},
+		{"60/300/0/0/3", CacheRule{L1TTL: 60 * s, L2TTL: 300 * s, RefreshAhead: 0, HotHits: 3}},
+	} {
+		got, err := parseCacheRule("test", tc.value, config)
+		tc.want.Name = "test"
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %+v, %v; want %+v", tc.value, got, err, tc.want)
+		}
+	}
+
+	for _, value := range []string{"", "a/b", "60/-1", "1/2/3/4/5/6", "60/300/0/101"} {
+		if rule, err := parseCacheRule("test", value, config); err == nil {
+			t.Errorf("%q was accepted as %+v", value, rule)
+		}
+	}
+}
+
+func TestDomainRuleOverridesRefreshAhead(t *testing.T) {
+	config := AppConfig{
+		CacheTTL2xx: "60/300", CacheTTL3xx: "0/300", CacheTTL4xx: "0/300", CacheTTL5xx: "0/300", CacheErrorTTL: "0/30",
+		CacheRefreshAhead: 80, CacheHotHits: 10,
+		CacheDomainTTLs: []string{"api.example.com=30/300/0/50/3"},
+	}
+	policy, err := NewCachePolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule := policy.RuleFor(URLResult{URL: "https://api.example.com/v1", Status: 200}); rule.RefreshAhead != 0.5 || rule.HotHits != 3 {
+		t.Errorf("domain rule refreshes at %.2f after %d hits, want 0.50 after 3", rule.RefreshAhead, rule.HotHits)
+	}
+	if rule := policy.RuleFor(URLResult{URL: "https://www.example.com/", Status: 200}); rule.RefreshAhead != 0.8 || rule.HotHits != 10 {
+		t.Errorf("2xx rule refreshes at %.2f after %d hits, want the defaults", rule.RefreshAhead, rule.HotHits)
+	}
+}
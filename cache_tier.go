@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// errCacheMiss is returned by a tier that doesn't hold the URL
+var errCacheMiss = errors.New("cache miss")
+
+// TierEntry is a cached result and the time its tier lifetime counts from
+type TierEntry struct {
+	Result   URLResult
+	StoredAt time.Time
+
+	// Lookups served by this entry, for tiers that count them
+	Hits int64
+}
+
+// CacheTier is one level of the cache chain. Lookup returns errCacheMiss for
+// absent URLs; any other error counts as a tier failure and the chain moves
+// on to the next tier. Store's lifetime runs from the tier's StoredAt.
+type CacheTier interface {
+	Kind() string
+	// Shared tiers are seen by every worker; local ones need invalidations
+	// broadcast to them
+	Shared() bool
+	Lookup(ctx context.Context, url string) (TierEntry, error)
+	Store(ctx context.Context, url string, result URLResult, lifetime time.Duration) error
+	Remove(ctx context.Context, url string) error
+}
+
+// TierPolicy is what a tier declares about its place in the chain
+type TierPolicy struct {
+	// TTL is how long a result stays fresh in the tier; 0 keeps it out
+	TTL func(rule CacheRule) time.Duration
+	// Promote copies hits from lower tiers into this tier
+	Promote bool
+	// Fill stores origin results in this tier
+	Fill bool
+}
+
+type ChainedTier struct {
+	CacheTier
+	Policy TierPolicy
+}
+
+func l1TTL(rule CacheRule) time.Duration { return rule.L1TTL }
+func l2TTL(rule CacheRule) time.Duration { return rule.L2TTL }
+
+// BuildCacheChain creates the tiers named in CACHE_TIERS, fastest first:
+// "memory" (LRU, L1 TTLs), "redis" (shared, L2 TTLs) and "postgres" (latest
+// check per URL in the region, read-only, fresh within the L2 TTL). "memory"
+// alone runs the cache without Redis. rdb and db are only needed by their
+// tiers.
+func BuildCacheChain(names []string, policy CachePolicy, region string, rdb *redis.Client, db *DBManager) ([]ChainedTier, error) {
+	var tiers []ChainedTier
+	for _, name := range names {
+		switch name {
+		case "memory":
+			tier, err := NewMemoryTier(policy.L1Size)
+			if err != nil {
+				return nil, err
+			}
+			tiers = append(tiers, ChainedTier{tier, TierPolicy{TTL: l1TTL, Promote: true, Fill: true}})
+		case "redis":
+			if rdb == nil {
+				return nil, fmt.Errorf("cache tier redis needs a Redis client")
+			}
+			tiers = append(tiers, ChainedTier{NewRedisTier(rdb, region, policy.Codec), TierPolicy{TTL: l2TTL, Promote: true, Fill: true}})
+		case "postgres":
+			if db == nil {
+				return nil, fmt.Errorf("cache tier postgres needs a database")
+			}
+			tiers = append(tiers, ChainedTier{NewPostgresTier(db, region), TierPolicy{TTL: l2TTL}})
+		default:
+			return nil, fmt.Errorf("unknown cache tier %q (want memory, redis or postgres)", name)
+		}
+	}
+	return tiers, nil
+}
+
+type memoryEntry struct {
+	result   URLResult
+	storedAt time.Time
+	lifetime time.Duration
+
+	// Shared across copies of the entry handed out by the LRU
+	hits *atomic.Int64
+}
+
+// MemoryTier is an in-process LRU. Entries are dropped lazily once their
+// lifetime is over.
+type MemoryTier struct {
+	lru *lru.Cache[string, memoryEntry]
+
+	// Every LRU eviction callback, and the ones we caused with Remove; the
+	// difference is capacity evictions
+	evicted  int64
+	removals int64
+}
+
+func NewMemoryTier(size int) (*MemoryTier, error) {
+	t := &MemoryTier{}
+	cache, err := lru.NewWithEvict(size, func(string, memoryEntry) {
+		atomic.AddInt64(&t.evicted, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.lru = cache
+	return t, nil
+}
+
+func (t *MemoryTier) Kind() string { return "memory" }
+func (t *MemoryTier) Shared() bool { return false }
+
+func (t *MemoryTier) Lookup(ctx context.Context, url string) (TierEntry, error) {
+	entry, ok := t.lru.Get(url)
+	if !ok {
+		return TierEntry{}, errCacheMiss
+	}
+	if time.Since(entry.storedAt) >= entry.lifetime {
+		t.remove(url)
+		return TierEntry{}, errCacheMiss
+	}
+	return TierEntry{Result: entry.result, StoredAt: entry.storedAt, Hits: entry.hits.Add(1)}, nil
+}
+
+func (t *MemoryTier) Store(ctx context.Context, url string, result URLResult, lifetime time.Duration) error {
+	t.lru.Add(url, memoryEntry{
+		result:   result,
+		storedAt: time.Now(),
+		lifetime: lifetime,
+		hits:     &atomic.Int64{},
+	})
+	return nil
+}
+
+// Remove drops an entry on purpose, so it isn't counted as an eviction
+func (t *MemoryTier) Remove(ctx context.Context, url string) error {
+	t.remove(url)
+	return nil
+}
+
+func (t *MemoryTier) remove(url string) bool {
+	if t.lru.Remove(url) {
+		atomic.AddInt64(&t.removals, 1)
+		return true
+	}
+	return false
+}
+
+// Invalidate drops matching entries and returns how many there were
+func (t *MemoryTier) Invalidate(inv CacheInvalidation) int {
+	if inv.URL != "" {
+		if t.remove(inv.URL) {
+			return 1
+		}
+		return 0
+	}
+
+	removed := 0
+	for _, url := range t.lru.Keys() {
+		if inv.Matches(url) && t.remove(url) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// HotKeys returns the hit counts of the n most-hit entries
+func (t *MemoryTier) HotKeys(n int) map[string]int64 {
+	type hot struct {
+		url  string
+		hits int64
+	}
+	var entries []hot
+	for _, url := range t.lru.Keys() {
+		if entry, ok := t.lru.Peek(url); ok {
+			if hits := entry.hits.Load(); hits > 0 {
+				entries = append(entries, hot{url, hits})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hits > entries[j].hits })
+
+	top := make(map[string]int64, min(n, len(entries)))
+	for _, e := range entries[:min(n, len(entries))] {
+		top[e.url] = e.hits
+	}
+	return top
+}
+
+// Evictions reports capacity evictions and deliberate removals
+func (t *MemoryTier) Evictions() (evicted, removed int64) {
+	removed = atomic.LoadInt64(&t.removals)
+	return atomic.LoadInt64(&t.evicted) - removed, removed
+}
+
+// RedisTier is the shared L2, keyed per region. Entries carry no storage
+// time, so their lifetime counts from the check itself.
+type RedisTier struct {
+	rdb    *redis.Client
+	region string
+	codec  CacheCodec
+}
+
+func NewRedisTier(rdb *redis.Client, region string, codec CacheCodec) *RedisTier {
+	return &RedisTier{rdb: rdb, region: region, codec: codec}
+}
+
+func (t *RedisTier) Kind() string { return "redis" }
+func (t *RedisTier) Shared() bool { return true }
+
+func (t *RedisTier) Lookup(ctx context.Context, url string) (TierEntry, error) {
+	data, err := t.rdb.Get(ctx, CacheKey(t.region, url)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return TierEntry{}, errCacheMiss
+	}
+	if err != nil {
+		return TierEntry{}, err
+	}
+
+	result, err := t.codec.Decode(data)
+	if err != nil {
+		return TierEntry{}, err
+	}
+	return TierEntry{Result: result, StoredAt: result.CheckedAt}, nil
+}
+
+func (t *RedisTier) Store(ctx context.Context, url string, result URLResult, lifetime time.Duration) error {
+	remaining := lifetime - time.Since(result.CheckedAt)
+	if remaining < time.Millisecond {
+		return nil
+	}
+	return t.rdb.Set(ctx, CacheKey(t.region, url), t.codec.Encode(result), remaining).Err()
+}
+
+func (t *RedisTier) Remove(ctx context.Context, url string) error {
+	return t.rdb.Del(ctx, CacheKey(t.region, url)).Err()
+}
+
+// PostgresTier answers from the latest stored check of a URL in its region.
+// It is read-only: checks get there through the results pipeline, not the
+// cache.
+type PostgresTier struct {
+	db      *DBManager
+	region  string
+	timeout time.Duration
+}
+
+func NewPostgresTier(db *DBManager, region string) *PostgresTier {
+	if region == "" {
+		region = defaultRegion
+	}
+	return &PostgresTier{db: db, region: region, timeout: 2 * time.Second}
+}
+
+func (t *PostgresTier) Kind() string { return "postgres" }
+func (t *PostgresTier) Shared() bool { return true }
+
+func (t *PostgresTier) Lookup(ctx context.Context, url string) (TierEntry, error) {
+	// DBManager only adds a timeout of its own when the context has none,
+	// and cancels it before the row is scanned
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	// Checks without a region were stored by untagged workers
+	var (
+		result   = URLResult{URL: url, Region: t.region}
+		status   sql.NullInt64
+		duration sql.NullInt64
+		errMsg   sql.NullString
+	)
+	err := t.db.QueryRow(ctx, `
+		SELECT c.status_code, c.response_time_ms, c.error_message, c.checked_at
+		FROM checks c JOIN urls u ON u.id = c.url_id
+		WHERE u.url = $1 AND COALESCE(c.region, $3) = $2
+		ORDER BY c.checked_at DESC
+		LIMIT 1`, url, t.region, defaultRegion).Scan(&status, &duration, &errMsg, &result.CheckedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TierEntry{}, errCacheMiss
+	}
+	if err != nil {
+		return TierEntry{}, err
+	}
+
+	result.Status = int(status.Int64)
+	result.Duration = duration.Int64
+	result.Error = errMsg.String
+	return TierEntry{Result: result, StoredAt: result.CheckedAt}, nil
+}
+
+func (t *PostgresTier) Store(ctx context.Context, url string, result URLResult, lifetime time.Duration) error {
+	return nil
+}
+
+func (t *PostgresTier) Remove(ctx context.Context, url string) error {
+	return nil
+}
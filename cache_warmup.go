@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Workers record their hottest L1 keys here (scored by hits) so a restarted
+// worker can pre-load them
+const hotKeysLimit = 1000
+
+func hotKeysKey(region string) string {
+	return "cache:hot:" + region
+}
+
+// RecordHotKeys keeps the highest hit count seen per URL, across workers of a
+// region, trimmed to the top hotKeysLimit
+func RecordHotKeys(ctx context.Context, rdb *redis.Client, region string, hits map[string]int64) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	members := make([]redis.Z, 0, len(hits))
+	for url, n := range hits {
+		members = append(members, redis.Z{Score: float64(n), Member: url})
+	}
+
+	key := hotKeysKey(region)
+	pipe := rdb.Pipeline()
+	pipe.ZAddGT(ctx, key, members...)
+	pipe.ZRemRangeByRank(ctx, key, 0, -hotKeysLimit-1)
+	pipe.Expire(ctx, key, 24*time.Hour)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// HotKeys returns the n hottest URLs of a region, hottest first
+func HotKeys(ctx context.Context, rdb *redis.Client, region string, n int) ([]string, error) {
+	return rdb.ZRevRange(ctx, hotKeysKey(region), 0, int64(n-1)).Result()
+}
+
+// RecentResults returns the latest result per region and URL from the
+// results list, newest first
+func RecentResults(ctx context.Context, rdb *redis.Client, limit int) ([]URLResult, error) {
+	raw, err := rdb.LRange(ctx, "results", 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var results []URLResult
+	for _, data := range raw {
+		result, err := DecodeResult([]byte(data))
+		if err != nil {
+			continue
+		}
+		// LPUSH puts the newest first, so the first one per key wins
+		key := CacheKey(result.Region, result.URL)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// RecentChecks returns the latest check per region and URL from Postgres,
+// newest first. Checks stored without a region belong to the default region.
+func RecentChecks(ctx context.Context, db *DBManager, limit int) ([]URLResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	rows, err := db.Query(ctx, `
+		SELECT url, region, status_code, response_time_ms, error_message, checked_at FROM (
+			SELECT DISTINCT ON (u.url, COALESCE(c.region, $2))
+				u.url, COALESCE(c.region, $2) AS region, c.status_code, c.response_time_ms, c.error_message, c.checked_at
+			FROM checks c JOIN urls u ON u.id = c.url_id
+			ORDER BY u.url, COALESCE(c.region, $2), c.checked_at DESC
+		) latest
+		ORDER BY checked_at DESC
+		LIMIT $1`, limit, defaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []URLResult
+	for rows.Next() {
+		var (
+			result   URLResult
+			status   sql.NullInt64
+			duration sql.NullInt64
+			errMsg   sql.NullString
+		)
+		if err := rows.Scan(&result.URL, &result.Region, &status, &duration, &errMsg, &result.CheckedAt); err != nil {
+			return nil, err
+		}
+		result.Status = int(status.Int64)
+		result.Duration = duration.Int64
+		result.Error = errMsg.String
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// ReadURLList reads one URL per line, skipping blanks and # comments
+func ReadURLList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		url := strings.TrimSpace(scanner.Text())
+		if url != "" && !strings.HasPrefix(url, "#") {
+			urls = append(urls, url)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+// CacheWarmer re-populates L2. Results that are still within their L2 TTL
+// are written directly; every other URL is queued for the workers at Rate
+// per second, so a cold cache doesn't turn into an origin stampede.
+type CacheWarmer struct {
+	rdb     *redis.Client
+	policy  CachePolicy
+	rate    int
+	regions []string
+}
+
+func NewCacheWarmer(rdb *redis.Client, policy CachePolicy, rate int, regions []string) *CacheWarmer {
+	if rate <= 0 {
+		rate = 1
+	}
+	if len(regions) == 0 {
+		regions = []string{defaultRegion}
+	}
+	return &CacheWarmer{rdb: rdb, policy: policy, rate: rate, regions: regions}
+}
+
+type WarmReport struct {
+	Targets      int
+	AlreadyWarm  int
+	Seeded       int
+	Enqueued     int
+	Skipped      int // the cache policy keeps these out of L2
+	OtherRegions int // results from regions the warmer doesn't serve
+	Covered      int
+
+	// Covered and total targets per region
+	Regions map[string][2]int
+	Elapsed time.Duration
+}
+
+func (r WarmReport) Coverage() float64 {
+	if r.Targets == 0 {
+		return 0
+	}
+	return float64(r.Covered) / float64(r.Targets) * 100
+}
+
+type warmTarget struct {
+	region string
+	url    string
+}
+
+func (t warmTarget) key() string {
+	return CacheKey(t.region, t.url)
+}
+
+// Warm seeds L2 from results and queues origin checks for the rest and for
+// urls (in every region of the warmer), then waits up to wait for workers to fill L2 and
+// reports coverage.
+func (w *CacheWarmer) Warm(ctx context.Context, results []URLResult, urls []string, wait time.Duration) (WarmReport, error) {
+	start := time.Now()
+	report := WarmReport{Regions: make(map[string][2]int)}
+
+	var targets, toFetch []warmTarget
+	seen := make(map[string]bool)
+	addTarget := func(t warmTarget) bool {
+		if seen[t.key()] {
+			return false
+		}
+		seen[t.key()] = true
+		targets = append(targets, t)
+		return true
+	}
+
+	for _, result := range results {
+		region := result.Region
+		if region == "" {
+			region = defaultRegion
+		}
+		if !slices.Contains(w.regions, region) {
+			// No worker reads that region's queue or L2 keys
+			report.OtherRegions++
+			continue
+		}
+		rule := w.policy.RuleFor(result)
+		if rule.L2TTL <= 0 {
+			report.Skipped++
+			continue
+		}
+		t := warmTarget{region: region, url: result.URL}
+		if !addTarget(t) {
+			continue
+		}
+
+		remaining := rule.L2TTL - time.Since(result.CheckedAt)
+		if remaining < time.Second {
+			toFetch = append(toFetch, t)
+			continue
+		}
+
+		// SetNX: never replace a value a worker wrote in the meantime
+		result.ServedBy, result.AgeMs = "", 0
+		written, err := w.rdb.SetNX(ctx, t.key(), w.policy.Codec.Encode(result), remaining).Result()
+		if err != nil {
+			return report, err
+		}
+		if written {
+			report.Seeded++
+		} else {
+			report.AlreadyWarm++
+		}
+	}
+
+	for _, url := range urls {
+		if rule, ok := w.policy.DomainRule(url); ok && rule.L2TTL <= 0 {
+			report.Skipped++
+			continue
+		}
+		for _, region := range w.regions {
+			t := warmTarget{region: region, url: url}
+			if addTarget(t) {
+				toFetch = append(toFetch, t)
+			}
+		}
+	}
+	report.Targets = len(targets)
+
+	enqueued, alreadyWarm, err := w.enqueue(ctx, toFetch)
+	report.Enqueued, report.AlreadyWarm = enqueued, report.AlreadyWarm+alreadyWarm
+	if err != nil {
+		return report, err
+	}
+
+	// Give the workers time to drain what we queued
+	deadline := time.Now().Add(wait)
+	for {
+		covered, err := w.covered(ctx, targets)
+		if err != nil {
+			return report, err
+		}
+		report.Covered = 0
+		report.Regions = make(map[string][2]int)
+		for i, t := range targets {
+			counts := report.Regions[t.region]
+			counts[1]++
+			if covered[i] {
+				counts[0]++
+				report.Covered++
+			}
+			report.Regions[t.region] = counts
+		}
+
+		if report.Covered == report.Targets || report.Enqueued == 0 || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return report, ctx.Err()
+		}
+	}
+
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// enqueue queues an origin check for each target missing from L2, at most
+// rate per second. They join the back of the queue behind regular checks.
+func (w *CacheWarmer) enqueue(ctx context.Context, targets []warmTarget) (enqueued, alreadyWarm int, err error) {
+	if len(targets) == 0 {
+		return 0, 0, nil
+	}
+
+	present, err := w.covered(ctx, targets)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(w.rate))
+	defer ticker.Stop()
+
+	runID := fmt.Sprintf("warmup-%d", time.Now().Unix())
+	for i, t := range targets {
+		if present[i] {
+			alreadyWarm++
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return enqueued, alreadyWarm, ctx.Err()
+		}
+
+		item := QueueItem{CheckID: fmt.Sprintf("%s:%d", runID, enqueued), RunID: runID, Attempt: 1, URL: t.url}
+		if err := w.rdb.LPush(ctx, QueueKey(t.region), item.Encode()).Err(); err != nil {
+			return enqueued, alreadyWarm, err
+		}
+		enqueued++
+	}
+	return enqueued, alreadyWarm, nil
+}
+
+// covered reports which targets currently have an L2 entry
+func (w *CacheWarmer) covered(ctx context.Context, targets []warmTarget) ([]bool, error) {
+	covered := make([]bool, len(targets))
+	for start := 0; start < len(targets); start += 500 {
+		end := min(start+500, len(targets))
+
+		pipe := w.rdb.Pipeline()
+		cmds := make([]*redis.IntCmd, 0, end-start)
+		for _, t := range targets[start:end] {
+			cmds = append(cmds, pipe.Exists(ctx, t.key()))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+		for i, cmd := range cmds {
+			covered[start+i] = cmd.Val() > 0
+		}
+	}
+	return covered, nil
+}
+
+// SortedRegions lists the report's regions in a stable order for printing
+func (r WarmReport) SortedRegions() []string {
+	regions := make([]string, 0, len(r.Regions))
+	for region := range r.Regions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
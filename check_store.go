@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SaveChecks writes a batch of results into the checks table on the leader,
+// creating missing urls rows first. Both statements take the whole batch as
+// arrays, so a batch is two round trips however large it is. Results whose
+// idempotency key is already in the table are skipped; SaveChecks reports
+// how many.
+func SaveChecks(ctx context.Context, db *DBManager, results []URLResult) (duplicates int, err error) {
+	if len(results) == 0 {
+		return 0, nil
+	}
+
+	var (
+		urls      = make([]string, len(results))
+		statuses  = make([]int64, len(results))
+		durations = make([]int64, len(results))
+		errs      = make([]string, len(results))
+		checkedAt = make([]string, len(results))
+		keys      = make([]string, len(results))
+		runIDs    = make([]string, len(results))
+		workerIDs = make([]string, len(results))
+		regions   = make([]string, len(results))
+	)
+	distinct := make(map[string]bool)
+	for i, result := range results {
+		urls[i] = result.URL
+		statuses[i] = int64(result.Status)
+		durations[i] = result.Duration
+		errs[i] = result.Error
+		at := result.CheckedAt
+		if at.IsZero() {
+			at = time.Now()
+		}
+		checkedAt[i] = at.Format(time.RFC3339Nano)
+		keys[i] = result.IdempotencyKey
+		runIDs[i], workerIDs[i], regions[i] = result.RunID, result.WorkerID, result.Region
+		distinct[result.URL] = true
+	}
+
+	// Sorted so concurrent workers lock new urls rows in the same order
+	// instead of deadlocking on each other
+	newURLs := make([]string, 0, len(distinct))
+	for url := range distinct {
+		newURLs = append(newURLs, url)
+	}
+	sort.Strings(newURLs)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO urls (url)
+		SELECT unnest($1::text[])
+		ON CONFLICT (url) DO NOTHING`, pq.Array(newURLs)); err != nil {
+		return 0, fmt.Errorf("upsert urls: %w", err)
+	}
+
+	// A separate statement, so urls rows committed by other workers since the
+	// first one are visible too. Status 0 means no response was received, and
+	// an empty key none to dedupe on (NULLs never conflict).
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO checks (url_id, checked_at, status_code, response_time_ms, error_message, idempotency_key, run_id, worker_id, region)
+		SELECT u.id, c.checked_at, NULLIF(c.status_code, 0), c.response_time_ms, NULLIF(c.error_message, ''), NULLIF(c.idempotency_key, ''),
+			NULLIF(c.run_id, ''), NULLIF(c.worker_id, ''), NULLIF(c.region, '')
+		FROM unnest($1::text[], $2::timestamptz[], $3::int[], $4::int[], $5::text[], $6::text[], $7::text[], $8::text[], $9::text[])
+			AS c(url, checked_at, status_code, response_time_ms, error_message, idempotency_key, run_id, worker_id, region)
+		JOIN urls u ON u.url = c.url
+		ON CONFLICT (idempotency_key) DO NOTHING`,
+		pq.Array(urls), pq.Array(checkedAt), pq.Array(statuses), pq.Array(durations), pq.Array(errs), pq.Array(keys),
+		pq.Array(runIDs), pq.Array(workerIDs), pq.Array(regions))
+	if err != nil {
+		return 0, fmt.Errorf("insert checks: %w", err)
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("insert checks: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(results) - int(inserted), nil
+}
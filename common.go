@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -10,35 +14,252 @@ import (
 var ctx = context.Background()
 
 type URLResult struct {
+	CheckID   string    `json:"check_id,omitempty"`
+	RunID     string    `json:"run_id,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	CheckType string    `json:"check_type,omitempty"`
 	URL       string    `json:"url"`
 	Status    int       `json:"status"`
 	Error     string    `json:"error,omitempty"`
+	ErrorKind string    `json:"error_kind,omitempty"`
 	Duration  int64     `json:"duration_ms"`
 	CheckedAt time.Time `json:"checked_at"`
 	WorkerID  string    `json:"worker_id"`
+	Region    string    `json:"region,omitempty"`
+	ServedBy  string    `json:"served_by,omitempty"`
+	AgeMs     int64     `json:"age_ms,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+
+	SecurityAudit *SecurityAudit `json:"security_audit,omitempty"`
+	Families      []FamilyResult `json:"families,omitempty"`
+	PartialOutage bool           `json:"partial_outage,omitempty"`
+
+	// Same for every delivery of one attempt at a check, see IdempotencyKey
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// Check types, recorded with every result
+const (
+	CheckTypeHTTP      = "http"
+	CheckTypeDualStack = "http_dualstack" // also checked over IPv4 and IPv6 separately
+)
+
+// Error kinds that need distinct handling downstream
+const (
+	ErrorKindSSRFBlocked = "ssrf_blocked"
+)
+
+// FamilyResult is the outcome of checking a URL over a single address family
+type FamilyResult struct {
+	Family     string `json:"family"`
+	Status     int    `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Duration   int64  `json:"duration_ms"`
+	Protocol   string `json:"protocol,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+}
+
+type SecurityFinding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+type SecurityAudit struct {
+	Score     int               `json:"score"`
+	Findings  []SecurityFinding `json:"findings,omitempty"`
+	AuditedAt time.Time         `json:"audited_at"`
 }
 
 type Stats struct {
-	QueueLength int `json:"queue_length"`
-	Success     int `json:"success"`
-	Error       int `json:"error"`
-	Processing  int `json:"processing"`
-	Total       int `json:"total"`
+	QueueLength   int `json:"queue_length"`
+	Success       int `json:"success"`
+	Error         int `json:"error"`
+	Processing    int `json:"processing"`
+	PartialOutage int `json:"partial_outage"`
+	SSRFBlocked   int `json:"ssrf_blocked"`
+	Total         int `json:"total"`
+}
+
+type FreshnessMode string
+
+const (
+	FreshnessDefault FreshnessMode = ""         // cache policy TTLs decide
+	FreshnessOrigin  FreshnessMode = "origin"   // must hit origin
+	FreshnessMaxAge  FreshnessMode = "max-age"  // cached data up to MaxAge seconds old
+	FreshnessStaleOK FreshnessMode = "stale-ok" // anything within TTL + stale-while-revalidate
+)
+
+// Freshness is how old a cached answer a check is willing to accept
+type Freshness struct {
+	Mode   FreshnessMode `json:"freshness,omitempty"`
+	MaxAge int           `json:"max_age,omitempty"`
+}
+
+// ParseFreshness accepts "origin", "stale-ok", "max-age=N" or "" (default)
+func ParseFreshness(value string) (Freshness, error) {
+	switch {
+	case value == "":
+		return Freshness{}, nil
+	case value == string(FreshnessOrigin), value == string(FreshnessStaleOK):
+		return Freshness{Mode: FreshnessMode(value)}, nil
+	case strings.HasPrefix(value, "max-age="):
+		seconds, err := strconv.Atoi(value[len("max-age="):])
+		if err != nil || seconds < 0 {
+			return Freshness{}, fmt.Errorf("invalid max-age in freshness %q", value)
+		}
+		return Freshness{Mode: FreshnessMaxAge, MaxAge: seconds}, nil
+	}
+	return Freshness{}, fmt.Errorf("unknown freshness %q", value)
+}
+
+// Accepts reports whether cached data of the given age satisfies the requirement
+func (f Freshness) Accepts(age time.Duration) bool {
+	switch f.Mode {
+	case FreshnessOrigin:
+		return false
+	case FreshnessMaxAge:
+		return age <= time.Duration(f.MaxAge)*time.Second
+	}
+	return true
+}
+
+// QueueItem is what the producer pushes onto a region queue. The same CheckID
+// is pushed to every targeted region so results can be compared per check.
+// Attempt numbers deliberate re-runs of a check, starting at 1; a queue
+// redelivering the same item keeps it, so the results dedupe. Older
+// producers leave it (and RunID) out.
+type QueueItem struct {
+	CheckID string `json:"check_id,omitempty"`
+	RunID   string `json:"run_id,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	URL     string `json:"url"`
+	Freshness
+}
+
+func (q QueueItem) Encode() string {
+	data, _ := json.Marshal(q)
+	return string(data)
+}
+
+// ParseQueueItem decodes a queue entry; bare URLs from older producers are
+// still accepted.
+func ParseQueueItem(raw string) QueueItem {
+	if strings.HasPrefix(raw, "{") {
+		var item QueueItem
+		if err := json.Unmarshal([]byte(raw), &item); err == nil && item.URL != "" {
+			return item
+		}
+	}
+	return QueueItem{URL: raw}
+}
+
+type RegionStats struct {
+	Region      string `json:"region"`
+	QueueLength int    `json:"queue_length"`
+	Success     int    `json:"success"`
+	Error       int    `json:"error"`
+}
+
+const (
+	defaultRegion = "default"
+	regionsKey    = "regions"
+)
+
+// QueueKey returns the queue consumed by workers of a region. Untagged workers
+// keep using the original url_queue.
+func QueueKey(region string) string {
+	if region == "" || region == defaultRegion {
+		return "url_queue"
+	}
+	return "url_queue:" + region
+}
+
+// RegionCounterKey scopes a counter such as "success" to a region
+func RegionCounterKey(counter, region string) string {
+	if region == "" {
+		region = defaultRegion
+	}
+	return counter + ":" + region
+}
+
+func GetRegions(rdb *redis.Client) []string {
+	regions, _ := rdb.SMembers(ctx, regionsKey).Result()
+	return regions
+}
+
+func GetRegionStats(rdb *redis.Client) []RegionStats {
+	var stats []RegionStats
+	for _, region := range GetRegions(rdb) {
+		queueLength, _ := rdb.LLen(ctx, QueueKey(region)).Result()
+		success, _ := rdb.Get(ctx, RegionCounterKey("success", region)).Int()
+		error, _ := rdb.Get(ctx, RegionCounterKey("error", region)).Int()
+
+		stats = append(stats, RegionStats{
+			Region:      region,
+			QueueLength: int(queueLength),
+			Success:     success,
+			Error:       error,
+		})
+	}
+	return stats
 }
 
 func GetStats(rdb *redis.Client) Stats {
 	queueLength, _ := rdb.LLen(ctx, "url_queue").Result()
+	for _, region := range GetRegions(rdb) {
+		if QueueKey(region) != "url_queue" {
+			n, _ := rdb.LLen(ctx, QueueKey(region)).Result()
+			queueLength += n
+		}
+	}
 	success, _ := rdb.Get(ctx, "success").Int()
 	error, _ := rdb.Get(ctx, "error").Int()
 	processing, _ := rdb.Get(ctx, "processing").Int()
+	partialOutage, _ := rdb.Get(ctx, "partial_outage").Int()
+	ssrfBlocked, _ := rdb.Get(ctx, "ssrf_blocked").Int()
 
 	return Stats{
-		QueueLength: int(queueLength),
-		Success:     success,
-		Error:       error,
-		Processing:  processing,
-		Total:       success + error + int(queueLength) + processing,
+		QueueLength:   int(queueLength),
+		Success:       success,
+		Error:         error,
+		Processing:    processing,
+		PartialOutage: partialOutage,
+		SSRFBlocked:   ssrfBlocked,
+		Total:         success + error + int(queueLength) + processing,
+	}
+}
+
+// Workers LPUSH every result onto this list; housekeeping trims it to
+// RESULTS_TO_KEEP and records its totals under resultsRetentionKey
+const (
+	resultsKey          = "results"
+	resultsRetentionKey = "results:retention"
+)
+
+// ResultsRetention is the size of the results list and what housekeeping has
+// trimmed from it
+type ResultsRetention struct {
+	Length      int64
+	MemoryBytes int64 // sampled estimate from MEMORY USAGE
+	Trimmed     int64
+	Archived    int64
+	LastTrim    time.Time
+}
+
+func GetResultsRetention(rdb *redis.Client) ResultsRetention {
+	var r ResultsRetention
+	r.Length, _ = rdb.LLen(ctx, resultsKey).Result()
+	r.MemoryBytes, _ = rdb.MemoryUsage(ctx, resultsKey).Result()
+
+	totals, _ := rdb.HGetAll(ctx, resultsRetentionKey).Result()
+	r.Trimmed, _ = strconv.ParseInt(totals["trimmed"], 10, 64)
+	r.Archived, _ = strconv.ParseInt(totals["archived"], 10, 64)
+	if lastTrim, _ := strconv.ParseInt(totals["last_trim"], 10, 64); lastTrim > 0 {
+		r.LastTrim = time.Unix(lastTrim, 0)
 	}
+	return r
 }
 
 func NewRedisClient(addr string) *redis.Client {
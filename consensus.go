@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	consensusPendingKey   = "consensus:pending"
+	consensusDecisionsKey = "consensus:decisions"
+	consensusLatestKey    = "consensus:latest"
+)
+
+type ConsensusVote struct {
+	Region    string    `json:"region"`
+	WorkerID  string    `json:"worker_id"`
+	Down      bool      `json:"down"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type ConsensusDecision struct {
+	CheckID   string          `json:"check_id"`
+	URL       string          `json:"url"`
+	State     string          `json:"state"`
+	DownVotes int             `json:"down_votes"`
+	UpVotes   int             `json:"up_votes"`
+	Required  int             `json:"required"`
+	Locations int             `json:"locations"`
+	Votes     []ConsensusVote `json:"votes"`
+	DecidedAt time.Time       `json:"decided_at"`
+}
+
+// ConsensusAggregator collects one vote per location for each check and only
+// declares a target down once Required of Locations votes agree. A location
+// is a region: a check is sent to each region once, and if a region checks it
+// again (a redelivery to another of its workers) the later vote replaces the
+// earlier one instead of counting twice. Any worker may finalize a check; a
+// SETNX claim makes sure only one of them does.
+type ConsensusAggregator struct {
+	rdb       *redis.Client
+	required  int
+	locations int
+	window    time.Duration
+	keep      int
+	stopChan  chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewConsensusAggregator(rdb *redis.Client, required, locations int, window time.Duration, keep int) (*ConsensusAggregator, error) {
+	// With more votes required than there are locations no outage would
+	// ever be declared
+	if locations < 1 {
+		return nil, fmt.Errorf("consensus needs at least one location, got %d", locations)
+	}
+	if required < 1 || required > locations {
+		return nil, fmt.Errorf("consensus needs 1 to %d of %d locations to agree, not %d", locations, locations, required)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid consensus window %s", window)
+	}
+	if keep < 1 {
+		return nil, fmt.Errorf("consensus needs to keep at least one decision, not %d", keep)
+	}
+
+	a := &ConsensusAggregator{
+		rdb:       rdb,
+		required:  required,
+		locations: locations,
+		window:    window,
+		keep:      keep,
+		stopChan:  make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
+
+func consensusVotesKey(checkID string) string {
+	return "consensus:votes:" + checkID
+}
+
+func consensusClaimKey(checkID string) string {
+	return "consensus:decided:" + checkID
+}
+
+// Vote records this location's view of a check and finalizes it early when
+// the outcome can no longer change.
+func (a *ConsensusAggregator) Vote(ctx context.Context, result URLResult) {
+	if result.CheckID == "" {
+		return
+	}
+
+	region := result.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	vote := ConsensusVote{
+		Region:    region,
+		WorkerID:  result.WorkerID,
+		Down:      result.Error != "",
+		Status:    result.Status,
+		Error:     result.Error,
+		CheckedAt: result.CheckedAt,
+	}
+	data, _ := json.Marshal(vote)
+
+	votesKey := consensusVotesKey(result.CheckID)
+	deadline := time.Now().Add(a.window)
+
+	pipe := a.rdb.TxPipeline()
+	pipe.HSet(ctx, votesKey, "url", result.URL, "vote:"+region, data)
+	pipe.Expire(ctx, votesKey, 4*a.window)
+	pipe.ZAddNX(ctx, consensusPendingKey, redis.Z{Score: float64(deadline.UnixMilli()), Member: result.CheckID})
+	votes := pipe.HGetAll(ctx, votesKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("❌ Consensus vote failed for %s: %v\n", result.CheckID, err)
+		return
+	}
+
+	if _, final := a.decide(parseVotes(votes.Val()), false); final {
+		a.finalize(ctx, result.CheckID)
+	}
+}
+
+func parseVotes(fields map[string]string) []ConsensusVote {
+	var votes []ConsensusVote
+	for field, data := range fields {
+		if !strings.HasPrefix(field, "vote:") {
+			continue
+		}
+		var vote ConsensusVote
+		if err := json.Unmarshal([]byte(data), &vote); err == nil {
+			votes = append(votes, vote)
+		}
+	}
+	return votes
+}
+
+// decide returns the state for a set of votes and whether it is final. Before
+// the window closes a state is only final once the missing votes can't change it.
+func (a *ConsensusAggregator) decide(votes []ConsensusVote, expired bool) (string, bool) {
+	down := 0
+	for _, vote := range votes {
+		if vote.Down {
+			down++
+		}
+	}
+	up := len(votes) - down
+
+	switch {
+	case down >= a.required:
+		return "down", true
+	case up > a.locations-a.required:
+		return "up", true
+	case !expired:
+		return "", false
+	case up > 0:
+		return "up", true
+	default:
+		return "inconclusive", true
+	}
+}
+
+func (a *ConsensusAggregator) finalize(ctx context.Context, checkID string) {
+	claimed, err := a.rdb.SetNX(ctx, consensusClaimKey(checkID), 1, 4*a.window).Result()
+	a.rdb.ZRem(ctx, consensusPendingKey, checkID)
+	if err != nil || !claimed {
+		return
+	}
+
+	fields, err := a.rdb.HGetAll(ctx, consensusVotesKey(checkID)).Result()
+	if err != nil {
+		log.Printf("❌ Consensus read failed for %s: %v\n", checkID, err)
+		return
+	}
+
+	votes := parseVotes(fields)
+	state, _ := a.decide(votes, true)
+
+	decision := ConsensusDecision{
+		CheckID:   checkID,
+		URL:       fields["url"],
+		State:     state,
+		Required:  a.required,
+		Locations: a.locations,
+		Votes:     votes,
+		DecidedAt: time.Now(),
+	}
+	for _, vote := range votes {
+		if vote.Down {
+			decision.DownVotes++
+		} else {
+			decision.UpVotes++
+		}
+	}
+
+	data, _ := json.Marshal(decision)
+	pipe := a.rdb.Pipeline()
+	pipe.LPush(ctx, consensusDecisionsKey, data)
+	pipe.LTrim(ctx, consensusDecisionsKey, 0, int64(a.keep-1))
+	pipe.HSet(ctx, consensusLatestKey, decision.URL, data)
+	pipe.Incr(ctx, "consensus_"+state)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("❌ Consensus store failed for %s: %v\n", checkID, err)
+		return
+	}
+
+	if state == "down" {
+		log.Printf("🚨 Consensus: %s is DOWN (%d/%d locations agree)\n", decision.URL, decision.DownVotes, a.locations)
+	}
+}
+
+// run closes checks whose window expired without every location reporting
+func (a *ConsensusAggregator) run() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.window / 4)
+	defer ticker.Stop()
+
+	sweep := func() {
+		ctx := context.Background()
+		now := time.Now().UnixMilli()
+		expired, err := a.rdb.ZRangeByScore(ctx, consensusPendingKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(now, 10),
+		}).Result()
+		if err != nil {
+			return
+		}
+		for _, checkID := range expired {
+			a.finalize(ctx, checkID)
+		}
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			sweep()
+		case <-a.stopChan:
+			return
+		}
+	}
+}
+
+func (a *ConsensusAggregator) Stop() {
+	close(a.stopChan)
+	a.wg.Wait()
+}
+
+func GetConsensusDecisions(ctx context.Context, rdb *redis.Client, count int64) ([]ConsensusDecision, error) {
+	entries, err := rdb.LRange(ctx, consensusDecisionsKey, 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := make([]ConsensusDecision, 0, len(entries))
+	for _, data := range entries {
+		var d ConsensusDecision
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			continue
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions, nil
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"sync/atomic"
 	"time"
+
+	_ "github.com/lib/pq"
 )
 
 type ctxKey string
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Published with the cache key once a lease holder has written L2
+const cacheFilledChannel = "cache:filled"
+
+// Cluster-wide counters, summed over every worker
+const (
+	stampedeLeasesKey    = "stampede:leases"
+	stampedeCoalescedKey = "stampede:coalesced"
+	stampedeTakeoversKey = "stampede:takeovers"
+	stampedeTimeoutsKey  = "stampede:wait_timeouts"
+)
+
+// Only the lease owner may release it; a crashed fetcher's lease just expires
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// renewLeaseScript extends a lease for ARGV[2] milliseconds, but only while
+// ARGV[1] still holds it
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// DistributedStampede is a Redis-lease single-flight across workers. The
+// worker holding "lease:<key>" fetches from origin and fills L2; the others
+// wait for a cache:filled notification (or poll L2) until the lease holder
+// finishes, the lease expires, or their own deadline passes. The holder
+// renews its lease while it fetches, so leaseTTL only bounds how long a
+// crashed holder blocks the key.
+//
+// The lease value is "<owner> <fetch start, unix ms>", so a waiter knows
+// which L2 values the fetch it waits on can have written.
+type DistributedStampede struct {
+	rdb          *redis.Client
+	owner        string
+	leaseTTL     time.Duration
+	waitTimeout  time.Duration
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+
+	leases    int64
+	coalesced int64
+	takeovers int64
+	timeouts  int64
+}
+
+func NewDistributedStampede(rdb *redis.Client, owner string, leaseTTL, waitTimeout time.Duration) *DistributedStampede {
+	return &DistributedStampede{
+		rdb:          rdb,
+		owner:        owner,
+		leaseTTL:     leaseTTL,
+		waitTimeout:  waitTimeout,
+		pollInterval: 100 * time.Millisecond,
+		waiters:      make(map[string][]chan struct{}),
+	}
+}
+
+func leaseKey(cacheKey string) string {
+	return "lease:" + cacheKey
+}
+
+func leaseValue(owner string, start time.Time) string {
+	return owner + " " + strconv.FormatInt(start.UnixMilli(), 10)
+}
+
+// leaseStart reads the fetch start out of a lease value
+func leaseStart(value string) (time.Time, bool) {
+	i := strings.LastIndexByte(value, ' ')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// Listen wakes local waiters as soon as another worker fills a key
+func (d *DistributedStampede) Listen(ctx context.Context) {
+	pubsub := d.rdb.Subscribe(ctx, cacheFilledChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		d.notify(msg.Payload)
+	}
+}
+
+func (d *DistributedStampede) notify(cacheKey string) {
+	d.mu.Lock()
+	waiters := d.waiters[cacheKey]
+	delete(d.waiters, cacheKey)
+	d.mu.Unlock()
+
+	for _, ch := range waiters {
+		close(ch)
+	}
+}
+
+func (d *DistributedStampede) wait(cacheKey string) chan struct{} {
+	ch := make(chan struct{})
+	d.mu.Lock()
+	d.waiters[cacheKey] = append(d.waiters[cacheKey], ch)
+	d.mu.Unlock()
+	return ch
+}
+
+// unwait drops a waiter that stopped waiting before being notified
+func (d *DistributedStampede) unwait(cacheKey string, ch chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	waiters := d.waiters[cacheKey]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(d.waiters, cacheKey)
+	} else {
+		d.waiters[cacheKey] = waiters
+	}
+}
+
+// Fetch returns lookup's value once another worker has filled the key
+// (coalesced=true), or runs fetch while holding the lease. fetch must write
+// L2 before returning so waiters can find the value. lookup is given the
+// start of the fetch being waited on (or of this call, while that is
+// unknown); values checked before it predate that fetch.
+func (d *DistributedStampede) Fetch(ctx context.Context, cacheKey string, lookup func(since time.Time) (URLResult, bool), fetch func() URLResult) (result URLResult, coalesced bool) {
+	since := time.Now()
+	deadline := since.Add(d.waitTimeout)
+	waited := false
+
+	for {
+		value := leaseValue(d.owner, time.Now())
+		acquired, err := d.rdb.SetNX(ctx, leaseKey(cacheKey), value, d.leaseTTL).Result()
+		if err != nil {
+			// Without Redis there is nothing to coordinate on
+			return fetch(), false
+		}
+
+		if acquired {
+			atomic.AddInt64(&d.leases, 1)
+			d.rdb.Incr(ctx, stampedeLeasesKey)
+			if waited {
+				// The previous holder crashed or released without filling L2
+				atomic.AddInt64(&d.takeovers, 1)
+				d.rdb.Incr(ctx, stampedeTakeoversKey)
+			}
+
+			renewCtx, stopRenewing := context.WithCancel(ctx)
+			go d.keepLease(renewCtx, cacheKey, value)
+			result = fetch()
+			stopRenewing()
+
+			releaseLeaseScript.Run(ctx, d.rdb, []string{leaseKey(cacheKey)}, value)
+			d.rdb.Publish(ctx, cacheFilledChannel, cacheKey)
+			return result, false
+		}
+
+		// Another worker holds the lease: wait for it to fill L2
+		waited = true
+		var outcome waitOutcome
+		result, since, outcome = d.waitForFill(ctx, cacheKey, since, deadline, lookup)
+		switch outcome {
+		case waitFilled:
+			atomic.AddInt64(&d.coalesced, 1)
+			d.rdb.Incr(ctx, stampedeCoalescedKey)
+			return result, true
+		case waitTimedOut:
+			atomic.AddInt64(&d.timeouts, 1)
+			d.rdb.Incr(ctx, stampedeTimeoutsKey)
+			log.Printf("⚠️ Stampede wait timed out for %s, fetching directly\n", cacheKey)
+			return fetch(), false
+		}
+		// waitLeaseGone: loop and try to take the lease
+	}
+}
+
+type waitOutcome int
+
+const (
+	waitFilled waitOutcome = iota
+	waitLeaseGone
+	waitTimedOut
+)
+
+// waitForFill waits on the current lease holder. since is the start of the
+// fetch it waits on, updated from the lease value whenever it is read.
+func (d *DistributedStampede) waitForFill(ctx context.Context, cacheKey string, since, deadline time.Time, lookup func(time.Time) (URLResult, bool)) (URLResult, time.Time, waitOutcome) {
+	notified := d.wait(cacheKey)
+	defer func() { d.unwait(cacheKey, notified) }()
+
+	for {
+		value, err := d.rdb.Get(ctx, leaseKey(cacheKey)).Result()
+		if start, ok := leaseStart(value); err == nil && ok {
+			since = start
+		}
+
+		if result, ok := lookup(since); ok {
+			return result, since, waitFilled
+		}
+
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			return URLResult{}, since, waitTimedOut
+		}
+
+		if err != nil {
+			// The holder fills L2 before releasing, so look once more
+			if result, ok := lookup(since); ok {
+				return result, since, waitFilled
+			}
+			return URLResult{}, since, waitLeaseGone
+		}
+
+		select {
+		case <-notified:
+			notified = d.wait(cacheKey)
+		case <-time.After(d.pollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// keepLease renews a held lease every third of its TTL until ctx is done
+func (d *DistributedStampede) keepLease(ctx context.Context, cacheKey, value string) {
+	ticker := time.NewTicker(d.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			renewLeaseScript.Run(ctx, d.rdb, []string{leaseKey(cacheKey)}, value, d.leaseTTL.Milliseconds())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type DistributedStampedeStats struct {
+	Leases    int64
+	Coalesced int64
+	Takeovers int64
+	Timeouts  int64
+}
+
+// GetStats returns this worker's counters; the cluster-wide totals live in
+// the stampede:* Redis counters.
+func (d *DistributedStampede) GetStats() DistributedStampedeStats {
+	return DistributedStampedeStats{
+		Leases:    atomic.LoadInt64(&d.leases),
+		Coalesced: atomic.LoadInt64(&d.coalesced),
+		Takeovers: atomic.LoadInt64(&d.takeovers),
+		Timeouts:  atomic.LoadInt64(&d.timeouts),
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Run with:
+//   go test -race distributed_stampede_test.go distributed_stampede.go cache_manager.go cache_tier.go cache_policy.go cache_codec.go cache_metrics.go cache_invalidation.go cache_warmup.go stampede.go latency_tracker.go db_manager.go result_envelope.go config.go common.go
+
+const stampedeTestKey = "cache:https://example.com/"
+
+func newStampedeRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+// holdLease takes the lease as another worker whose fetch started at start
+func holdLease(t *testing.T, mr *miniredis.Miniredis, cacheKey string, start time.Time) {
+	t.Helper()
+	mr.Set(leaseKey(cacheKey), leaseValue("worker-2", start))
+	mr.SetTTL(leaseKey(cacheKey), time.Minute)
+}
+
+func TestStampedeLeaseHolderFetches(t *testing.T) {
+	mr, rdb := newStampedeRedis(t)
+	d := NewDistributedStampede(rdb, "worker-1", time.Second, time.Second)
+
+	var calls int64
+	result, coalesced := d.Fetch(context.Background(), stampedeTestKey,
+		func(time.Time) (URLResult, bool) { return URLResult{}, false },
+		func() URLResult {
+			atomic.AddInt64(&calls, 1)
+			if !mr.Exists(leaseKey(stampedeTestKey)) {
+				t.Error("fetching without the lease")
+			}
+			return URLResult{Status: 200}
+		})
+
+	if calls != 1 || coalesced || result.Status != 200 {
+		t.Errorf("got %+v (coalesced=%v) after %d fetches, want one fetch", result, coalesced, calls)
+	}
+	if mr.Exists(leaseKey(stampedeTestKey)) {
+		t.Error("the lease wasn't released")
+	}
+	if stats := d.GetStats(); stats.Leases != 1 || stats.Coalesced != 0 {
+		t.Errorf("stats %+v, want one lease", stats)
+	}
+}
+
+func TestStampedeWaiterTakesTheHoldersValue(t *testing.T) {
+	mr, rdb := newStampedeRedis(t)
+	d := NewDistributedStampede(rdb, "worker-1", time.Second, 5*time.Second)
+
+	holderStart := time.Now().Truncate(time.Millisecond)
+	holdLease(t, mr, stampedeTestKey, holderStart)
+	var filled atomic.Bool
+	time.AfterFunc(200*time.Millisecond, func() { filled.Store(true) })
+
+	result, coalesced := d.Fetch(context.Background(), stampedeTestKey,
+		func(since time.Time) (URLResult, bool) {
+			if !since.Equal(holderStart) {
+				t.Errorf("lookup got since %v, want the holder's start %v", since, holderStart)
+			}
+			return URLResult{Status: 200, WorkerID: "worker-2"}, filled.Load()
+		},
+		func() URLResult {
+			t.Error("a waiter fetched while the lease was held")
+			return URLResult{}
+		})
+
+	if !coalesced || result.WorkerID != "worker-2" {
+		t.Errorf("got %+v (coalesced=%v), want the holder's result", result, coalesced)
+	}
+	if stats := d.GetStats(); stats.Coalesced != 1 || stats.Leases != 0 {
+		t.Errorf("stats %+v, want one coalesced wait", stats)
+	}
+}
+
+func TestStampedeTakeover(t *testing.T) {
+	mr, rdb := newStampedeRedis(t)
+	d := NewDistributedStampede(rdb, "worker-1", time.Second, 5*time.Second)
+
+	// The holder dies without filling L2; its lease runs out
+	holdLease(t, mr, stampedeTestKey, time.Now())
+	time.AfterFunc(200*time.Millisecond, func() { mr.Del(leaseKey(stampedeTestKey)) })
+
+	var calls int64
+	_, coalesced := d.Fetch(context.Background(), stampedeTestKey,
+		func(time.Time) (URLResult, bool) { return URLResult{}, false },
+		func() URLResult {
+			atomic.AddInt64(&calls, 1)
+			return URLResult{Status: 200}
+		})
+
+	if calls != 1 || coalesced {
+		t.Errorf("%d fetches (coalesced=%v), want one after taking over", calls, coalesced)
+	}
+	if stats := d.GetStats(); stats.Takeovers != 1 || stats.Leases != 1 {
+		t.Errorf("stats %+v, want one takeover", stats)
+	}
+}
+
+func TestStampedeWaitTimeout(t *testing.T) {
+	mr, rdb := newStampedeRedis(t)
+	d := NewDistributedStampede(rdb, "worker-1", time.Second, 300*time.Millisecond)
+	holdLease(t, mr, stampedeTestKey, time.Now())
+
+	start := time.Now()
+	var calls int64
+	_, coalesced := d.Fetch(context.Background(), stampedeTestKey,
+		func(time.Time) (URLResult, bool) { return URLResult{}, false },
+		func() URLResult {
+			atomic.AddInt64(&calls, 1)
+			return URLResult{Status: 200}
+		})
+
+	if calls != 1 || coalesced || time.Since(start) < 300*time.Millisecond {
+		t.Errorf("%d fetches (coalesced=%v) after %v, want one after the wait timeout", calls, coalesced, time.Since(start))
+	}
+	if stats := d.GetStats(); stats.Timeouts != 1 {
+		t.Errorf("stats %+v, want one timeout", stats)
+	}
+	if value, _ := mr.Get(leaseKey(stampedeTestKey)); value == "" || mr.TTL(leaseKey(stampedeTestKey)) == 0 {
+		t.Error("the other worker's lease was touched")
+	}
+}
+
+func TestStampedeRenewsTheLeaseWhileFetching(t *testing.T) {
+	mr, rdb := newStampedeRedis(t)
+
+	// A 300ms lease, renewed every 100ms, while the fetch takes 600ms
+	d := NewDistributedStampede(rdb, "worker-1", 300*time.Millisecond, time.Second)
+	d.Fetch(context.Background(), stampedeTestKey,
+		func(time.Time) (URLResult, bool) { return URLResult{}, false },
+		func() URLResult {
+			for i := 0; i < 4; i++ {
+				time.Sleep(150 * time.Millisecond)
+				mr.FastForward(150 * time.Millisecond)
+			}
+			if !mr.Exists(leaseKey(stampedeTestKey)) {
+				t.Error("the lease expired mid-fetch")
+			}
+			return URLResult{Status: 200}
+		})
+}
+
+// A must-hit-origin check waiting on another worker's fetch must not be
+// answered with what L2 held before that fetch
+func TestOriginCheckWaitsForTheNewValue(t *testing.T) {
+	mr, rdb := newStampedeRedis(t)
+	url := "https://example.com/"
+
+	policy, err := NewCachePolicy(LoadConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers, err := BuildCacheChain([]string{"redis"}, policy, "", rdb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDistributedStampede(rdb, "worker-1", time.Second, 5*time.Second)
+	cm, err := NewCacheManager(policy, tiers, NewSingleFlight[string, URLResult](), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// L2 holds a result from half a second ago, and worker-2 has just started a fetch
+	old := URLResult{URL: url, Status: 200, WorkerID: "old", CheckedAt: time.Now().Add(-500 * time.Millisecond)}
+	tiers[0].Store(context.Background(), url, old, time.Minute)
+	holderStart := time.Now()
+	holdLease(t, mr, CacheKey("", url), holderStart)
+
+	time.AfterFunc(300*time.Millisecond, func() {
+		fresh := URLResult{URL: url, Status: 200, WorkerID: "worker-2", CheckedAt: holderStart.Add(10 * time.Millisecond)}
+		tiers[0].Store(context.Background(), url, fresh, time.Minute)
+		mr.Del(leaseKey(CacheKey("", url)))
+	})
+
+	var calls int64
+	result := cm.Get(context.Background(), url, Freshness{Mode: FreshnessOrigin}, func(string) URLResult {
+		atomic.AddInt64(&calls, 1)
+		return URLResult{URL: url, Status: 200, WorkerID: "worker-1", CheckedAt: time.Now()}
+	})
+
+	if result.WorkerID != "worker-2" || calls != 0 {
+		t.Errorf("got the result of %s after %d fetches, want worker-2's coalesced fetch", result.WorkerID, calls)
+	}
+}
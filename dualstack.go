@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var addressFamilies = []struct {
+	name    string
+	network string
+	lookup  string
+}{
+	{"ipv4", "tcp4", "ip4"},
+	{"ipv6", "tcp6", "ip6"},
+}
+
+// DualStackChecker checks a URL once per address family. The shared httpClient
+// dials whatever the resolver returns first, so a broken IPv6 path stays
+// invisible unless each family gets its own pinned transport.
+type DualStackChecker struct {
+	clients  map[string]*http.Client
+	timeout  time.Duration
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+func NewDualStackChecker(timeout time.Duration, guard *SSRFGuard) *DualStackChecker {
+	d := &DualStackChecker{
+		clients:  make(map[string]*http.Client),
+		timeout:  timeout,
+		lookupIP: net.DefaultResolver.LookupIP,
+	}
+	for _, family := range addressFamilies {
+		d.clients[family.name] = newFamilyClient(family.network, timeout, guard)
+	}
+	return d
+}
+
+func newFamilyClient(network string, timeout time.Duration, guard *SSRFGuard) *http.Client {
+	dialer := guard.Dialer(timeout)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			// A custom DialContext disables HTTP/2 unless forced
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// Check runs the IPv4 and IPv6 checks in parallel. partial is true when one
+// family works and the other fails.
+func (d *DualStackChecker) Check(ctx context.Context, rawURL string) (families []FamilyResult, partial bool) {
+	families = make([]FamilyResult, len(addressFamilies))
+
+	var wg sync.WaitGroup
+	for i, family := range addressFamilies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			families[i] = d.checkFamily(ctx, rawURL, family.name, family.lookup)
+		}()
+	}
+	wg.Wait()
+
+	var up, down int
+	for _, f := range families {
+		if f.Skipped {
+			continue
+		}
+		if f.Error == "" {
+			up++
+		} else {
+			down++
+		}
+	}
+	return families, up > 0 && down > 0
+}
+
+func (d *DualStackChecker) checkFamily(ctx context.Context, rawURL, family, lookup string) FamilyResult {
+	res := FamilyResult{Family: family}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	// Hosts without records for this family aren't an outage, just not
+	// dual-stack. A lookup that failed (timeout, SERVFAIL) says nothing about
+	// the records, so the family counts as down.
+	lookupCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	ips, err := d.lookupIP(lookupCtx, lookup, u.Hostname())
+	var dnsErr *net.DNSError
+	if (err == nil && len(ips) == 0) || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		res.Skipped = true
+		res.Error = fmt.Sprintf("no %s address for %s", family, u.Hostname())
+		return res
+	}
+	if err != nil {
+		res.Error = fmt.Sprintf("%s lookup failed: %v", family, err)
+		return res
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			res.RemoteAddr = info.Conn.RemoteAddr().String()
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, rawURL, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	start := time.Now()
+	resp, err := d.clients[family].Do(req)
+	res.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+
+	res.Status = resp.StatusCode
+	res.Protocol = negotiatedProtocol(resp)
+	if resp.StatusCode != 200 {
+		res.Error = fmt.Sprintf("HTTP %d", resp.StatusCode)
+	}
+	return res
+}
+
+// negotiatedProtocol reports the ALPN result ("h2" or "http/1.1"), falling back
+// to the response protocol version for plain HTTP.
+func negotiatedProtocol(resp *http.Response) string {
+	if resp.TLS != nil && resp.TLS.NegotiatedProtocol != "" {
+		return resp.TLS.NegotiatedProtocol
+	}
+	if resp.ProtoMajor == 2 {
+		return "h2"
+	}
+	return "http/1.1"
+}
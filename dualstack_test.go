@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run with:
+//   go test dualstack_test.go dualstack.go ssrf_guard.go common.go
+
+func TestDualStackLookupErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name        string
+		ipv6        error
+		wantSkipped bool
+		wantPartial bool
+	}{
+		{"no AAAA records", &net.DNSError{Err: "no such host", IsNotFound: true}, true, false},
+		{"no answer", nil, true, false},
+		{"timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, false, true},
+		{"SERVFAIL", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, false, true},
+	} {
+		d := NewDualStackChecker(2*time.Second, nil)
+		d.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+			if network == "ip4" {
+				return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+			}
+			return nil, tc.ipv6
+		}
+
+		families, partial := d.Check(context.Background(), server.URL)
+		ipv4, ipv6 := families[0], families[1]
+		if ipv4.Error != "" || ipv4.Status != 200 {
+			t.Errorf("%s: ipv4 got %d %q, want 200", tc.name, ipv4.Status, ipv4.Error)
+		}
+		if ipv6.Skipped != tc.wantSkipped || ipv6.Error == "" {
+			t.Errorf("%s: ipv6 skipped=%v error=%q, want skipped=%v with an error", tc.name, ipv6.Skipped, ipv6.Error, tc.wantSkipped)
+		}
+		if tc.ipv6 != nil && !tc.wantSkipped && !strings.Contains(ipv6.Error, tc.ipv6.Error()) {
+			t.Errorf("%s: ipv6 error %q doesn't say why the lookup failed", tc.name, ipv6.Error)
+		}
+		if partial != tc.wantPartial {
+			t.Errorf("%s: partial=%v, want %v", tc.name, partial, tc.wantPartial)
+		}
+	}
+}
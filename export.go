@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	// Skip the .go files passed to `go run`; the rest are key=value filters,
+	// the same ones GET /export takes
+	values := url.Values{}
+	for _, arg := range os.Args[1:] {
+		if strings.HasSuffix(arg, ".go") {
+			continue
+		}
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			log.Fatal("Usage: go run export.go common.go config.go db_manager.go result_export.go\n" +
+				"         [format=csv|jsonl|parquet] [out=<file>] [run=<id>] [from=<time>] [to=<time>]\n" +
+				"         [status=2xx,3xx,4xx,5xx,error] [domain=<host>] [tag=<name>] [worker=<id>] [region=<name>]")
+		}
+		values.Add(key, value)
+	}
+
+	format, err := ParseExportFormat(values.Get("format"))
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	filter, err := ParseExportFilter(values)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	// Load config
+	config := LoadConfig()
+
+	db, err := NewDBManager(config.LeaderDSN, config.FollowerDSN)
+	if err != nil {
+		log.Fatalf("❌ could not connect to Postgres: %v", err)
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if path := values.Get("out"); path != "" && path != "-" {
+		if out, err = os.Create(path); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer out.Close()
+	}
+
+	start := time.Now()
+	cursor, err := QueryExport(ctx, db, filter, time.Duration(config.ExportTimeout)*time.Second)
+	if err != nil {
+		log.Fatalf("❌ export query failed: %v", err)
+	}
+	defer cursor.Close()
+
+	w, err := NewExportWriter(format, out)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	rows, err := cursor.Copy(&progressWriter{ExportWriter: w})
+	if err != nil {
+		log.Fatalf("❌ export failed after %d rows: %v", rows, err)
+	}
+
+	log.Printf("✅ Exported %d checks as %s to %s in %s\n", rows, format, out.Name(), time.Since(start).Round(time.Millisecond))
+}
+
+// progressWriter logs every 100k rows, so a long export shows it is moving
+type progressWriter struct {
+	ExportWriter
+	rows int64
+}
+
+func (p *progressWriter) Write(row ExportRow) error {
+	p.rows++
+	if p.rows%100000 == 0 {
+		log.Printf("📤 %d checks exported...\n", p.rows)
+	}
+	return p.ExportWriter.Write(row)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Workers publish their ResultsFlusher metrics here next to the cache
+// metrics, one field per worker
+const flusherMetricsKey = "flusher:metrics"
+
+// FlusherMetrics shows how the results buffer copes with load. Counters are
+// totals since the worker started.
+type FlusherMetrics struct {
+	WorkerID  string    `json:"worker_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Policy    string    `json:"policy"`
+
+	Depth    int   `json:"depth"`
+	Capacity int   `json:"capacity"`
+	Added    int64 `json:"added"`
+
+	// Adds that found the buffer full, and how long the block policy made
+	// them wait in total
+	Full          int64 `json:"full"`
+	BlockedMs     int64 `json:"blocked_ms"`
+	BlockTimeouts int64 `json:"block_timeouts"`
+
+	Dropped  int64 `json:"dropped"`
+	Spilled  int64 `json:"spilled"`
+	Replayed int64 `json:"replayed"`
+
+	// Results the sinks skipped as already stored, summed over sinks
+	Duplicates int64 `json:"duplicates"`
+
+	// Where the adaptive batching stands: the size that triggers a flush,
+	// the longest a result waits for one, and the arrival rate they follow
+	Flushes     int64   `json:"flushes"`
+	BatchTarget int     `json:"batch_target"`
+	IntervalMs  int64   `json:"interval_ms"`
+	ArrivalRate float64 `json:"arrival_rate"`
+
+	Sinks map[string]SinkFlushMetrics `json:"sinks,omitempty"`
+}
+
+// SinkFlushMetrics is what one sink made of the batches it was given.
+// Attempts counts every write call, retries and spool replays included, so
+// Results/Attempts is how many results each call to the sink carried.
+type SinkFlushMetrics struct {
+	Batches    int64             `json:"batches"`
+	Results    int64             `json:"results"`
+	Attempts   int64             `json:"attempts"`
+	Errors     int64             `json:"errors"`   // failed attempts
+	Failures   int64             `json:"failures"` // batches given up on after every retry
+	Durations  HistogramSnapshot `json:"durations"`
+	BatchSizes SizeSnapshot      `json:"batch_sizes"`
+}
+
+func (m *SinkFlushMetrics) Merge(other SinkFlushMetrics) {
+	m.Batches += other.Batches
+	m.Results += other.Results
+	m.Attempts += other.Attempts
+	m.Errors += other.Errors
+	m.Failures += other.Failures
+	m.Durations.Merge(other.Durations)
+	m.BatchSizes.Merge(other.BatchSizes)
+}
+
+// ResultsPerCall is the batching factor: how many single-result writes each
+// call to the sink replaced
+func (m SinkFlushMetrics) ResultsPerCall() float64 {
+	if m.Attempts == 0 {
+		return 0
+	}
+	return float64(m.Results) / float64(m.Attempts)
+}
+
+// Upper bounds of the batch size buckets, 1-2-5 per decade like the latency
+// buckets
+var batchSizeBuckets = []int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1_000, 2_000, 5_000, 10_000, 20_000, math.MaxInt64}
+
+// SizeHistogram counts batch sizes into batchSizeBuckets
+type SizeHistogram struct {
+	counts []int64
+	sum    int64
+}
+
+func NewSizeHistogram() *SizeHistogram {
+	return &SizeHistogram{counts: make([]int64, len(batchSizeBuckets))}
+}
+
+func (h *SizeHistogram) Observe(size int) {
+	i := sort.Search(len(batchSizeBuckets), func(i int) bool { return batchSizeBuckets[i] >= int64(size) })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(size))
+}
+
+func (h *SizeHistogram) Snapshot() SizeSnapshot {
+	s := SizeSnapshot{Counts: make([]int64, len(h.counts)), Sum: atomic.LoadInt64(&h.sum)}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return s
+}
+
+// SizeSnapshot is a point-in-time copy of a SizeHistogram
+type SizeSnapshot struct {
+	Counts []int64 `json:"counts"`
+	Sum    int64   `json:"sum"`
+}
+
+func (s SizeSnapshot) Count() int64 {
+	var n int64
+	for _, c := range s.Counts {
+		n += c
+	}
+	return n
+}
+
+func (s SizeSnapshot) Mean() float64 {
+	n := s.Count()
+	if n == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(n)
+}
+
+// Quantile returns the upper bound of the bucket holding quantile q; the
+// open last bucket reports the mean
+func (s SizeSnapshot) Quantile(q float64) int64 {
+	n := s.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(n)))
+	var seen int64
+	for i, c := range s.Counts {
+		seen += c
+		if seen >= rank {
+			if i == len(batchSizeBuckets)-1 {
+				return int64(s.Mean())
+			}
+			return batchSizeBuckets[i]
+		}
+	}
+	return 0
+}
+
+func (s *SizeSnapshot) Merge(other SizeSnapshot) {
+	if len(s.Counts) < len(other.Counts) {
+		s.Counts = append(s.Counts, make([]int64, len(other.Counts)-len(s.Counts))...)
+	}
+	for i, c := range other.Counts {
+		s.Counts[i] += c
+	}
+	s.Sum += other.Sum
+}
+
+func PublishFlusherMetrics(ctx context.Context, rdb *redis.Client, m FlusherMetrics) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, flusherMetricsKey, m.WorkerID, data).Err()
+}
+
+// GetFlusherMetrics sums the snapshots of workers that published within
+// maxAge, and reports how many that was. BatchTarget and IntervalMs are
+// averaged over them instead.
+func GetFlusherMetrics(ctx context.Context, rdb *redis.Client, maxAge time.Duration) (FlusherMetrics, int) {
+	var total FlusherMetrics
+
+	snapshots, err := rdb.HGetAll(ctx, flusherMetricsKey).Result()
+	if err != nil {
+		return total, 0
+	}
+
+	workers := 0
+	for _, raw := range snapshots {
+		var m FlusherMetrics
+		if err := json.Unmarshal([]byte(raw), &m); err != nil || time.Since(m.UpdatedAt) > maxAge {
+			continue
+		}
+		workers++
+
+		total.Depth += m.Depth
+		total.Capacity += m.Capacity
+		total.Added += m.Added
+		total.Full += m.Full
+		total.BlockedMs += m.BlockedMs
+		total.BlockTimeouts += m.BlockTimeouts
+		total.Dropped += m.Dropped
+		total.Spilled += m.Spilled
+		total.Replayed += m.Replayed
+		total.Duplicates += m.Duplicates
+		total.Flushes += m.Flushes
+		total.BatchTarget += m.BatchTarget
+		total.IntervalMs += m.IntervalMs
+		total.ArrivalRate += m.ArrivalRate
+		for name, sink := range m.Sinks {
+			if total.Sinks == nil {
+				total.Sinks = make(map[string]SinkFlushMetrics)
+			}
+			merged := total.Sinks[name]
+			merged.Merge(sink)
+			total.Sinks[name] = merged
+		}
+		if total.Policy == "" || total.Policy == m.Policy {
+			total.Policy = m.Policy
+		} else {
+			total.Policy = "mixed"
+		}
+		if m.UpdatedAt.After(total.UpdatedAt) {
+			total.UpdatedAt = m.UpdatedAt
+		}
+	}
+	if workers > 0 {
+		total.BatchTarget /= workers
+		total.IntervalMs /= int64(workers)
+	}
+	return total, workers
+}
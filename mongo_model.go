@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// MongoDB keeps one document per URL with its checks embedded, so a URL's
+// history is a single read
+
+type CheckResult struct {
+	Status     int       `bson:"status"`
+	DurationMs int       `bson:"duration_ms"`
+	CheckedAt  time.Time `bson:"checked_at"`
+	WorkerID   string    `bson:"worker_id"`
+	ErrorMsg   *string   `bson:"error_msg,omitempty"`
+	Tags       []string  `bson:"tags"`
+
+	IdempotencyKey string `bson:"idempotency_key,omitempty"`
+}
+
+type URLDocument struct {
+	URL    string        `bson:"url"`
+	Domain string        `bson:"domain"`
+	Checks []CheckResult `bson:"checks"`
+}
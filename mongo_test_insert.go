@@ -11,21 +11,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type CheckResult struct {
-	Status     int       `bson:"status"`
-	DurationMs int       `bson:"duration_ms"`
-	CheckedAt  time.Time `bson:"checked_at"`
-	WorkerID   string    `bson:"worker_id"`
-	ErrorMsg   *string   `bson:"error_msg,omitempty"`
-	Tags       []string  `bson:"tags"`
-}
-
-type URLDocument struct {
-	URL    string        `bson:"url"`
-	Domain string        `bson:"domain"`
-	Checks []CheckResult `bson:"checks"`
-}
-
 func main() {
 	// Connect to MongoDB
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
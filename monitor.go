@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -26,8 +28,12 @@ func main() {
 
 	for range ticker.C {
 		stats := GetStats(rdb)
-		cacheHits, _ := rdb.Get(ctx, "cache_hit").Int64()
-		cacheMisses, _ := rdb.Get(ctx, "cache_miss").Int64()
+		cache, _ := GetCacheMetrics(ctx, rdb, cacheMetricsMaxAge)
+		flusher, _ := GetFlusherMetrics(ctx, rdb, cacheMetricsMaxAge)
+		retention := GetResultsRetention(rdb)
+		cacheHits := cache.CacheHits()
+		cacheMisses := cache.Origin
+		coalesced, _ := rdb.Get(ctx, "stampede:coalesced").Int64()
 
 		completed := stats.Success + stats.Error
 		elapsed := time.Since(startTime).Seconds()
@@ -58,7 +64,7 @@ func main() {
 
 		// Display
 		fmt.Printf("\r\033[K") // Clear line
-		fmt.Printf("📊 Queue: %6d | ⚙️  Processing: %3d | ✅ Success: %8d | ❌ Error: %8d | Progress: %.1f%% | Rate: %.0f/s | ETA: %s | 🎯 Cache Hit: %.1f%% (%d hits)",
+		fmt.Printf("📊 Queue: %6d | ⚙️  Processing: %3d | ✅ Success: %8d | ❌ Error: %8d | Progress: %.1f%% | Rate: %.0f/s | ETA: %s | 🎯 Cache Hit: %.1f%% (%d hits) | 🤝 Coalesced: %d | 🧹 Evicted: %d | ⚠️  Cache Errors: %d | 🚰 Buffer: %d/%d | 🗑️  Dropped: %d | 📦 Redis calls saved: %.0fx | 📜 Results: %d (%.1f MB)",
 			stats.QueueLength,
 			stats.Processing,
 			stats.Success,
@@ -68,6 +74,15 @@ func main() {
 			eta,
 			hitRate,
 			cacheHits,
+			coalesced,
+			cache.Evictions,
+			cache.TotalErrors(),
+			flusher.Depth,
+			flusher.Capacity,
+			flusher.Dropped,
+			flusher.Sinks["redis"].ResultsPerCall(),
+			retention.Length,
+			float64(retention.MemoryBytes)/(1<<20),
 		)
 
 		// Check if done
@@ -77,6 +92,9 @@ func main() {
 			fmt.Printf("❌ Errors: %d\n", stats.Error)
 			fmt.Printf("⏱️  Total Time: %s\n", formatDuration(time.Since(startTime)))
 			fmt.Printf("📈 Average Rate: %.0f URLs/sec\n", overallRate)
+			printCacheSummary(cache)
+			printFlusherSummary(flusher)
+			printRetentionSummary(retention)
 			break
 		}
 
@@ -85,6 +103,79 @@ func main() {
 	}
 }
 
+// printFlusherSummary shows how the workers' result buffers coped
+func printFlusherSummary(flusher FlusherMetrics) {
+	if flusher.Added == 0 {
+		return
+	}
+	fmt.Printf("\n🚰 Results buffer (policy: %s): %d added, %d found it full\n", flusher.Policy, flusher.Added, flusher.Full)
+	fmt.Printf("   blocked %s (%d timeouts) | dropped %d | spilled %d | fed back %d\n",
+		time.Duration(flusher.BlockedMs)*time.Millisecond, flusher.BlockTimeouts,
+		flusher.Dropped, flusher.Spilled, flusher.Replayed)
+	fmt.Printf("   duplicates suppressed by the sinks: %d\n", flusher.Duplicates)
+	fmt.Printf("   batching: %d flushes | now %d results or %s (average per worker) | %.0f results/sec\n",
+		flusher.Flushes, flusher.BatchTarget, time.Duration(flusher.IntervalMs)*time.Millisecond, flusher.ArrivalRate)
+
+	// One write call per batch instead of one per result: ResultsPerCall is
+	// how many calls batching saved each sink
+	names := make([]string, 0, len(flusher.Sinks))
+	for name := range flusher.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := flusher.Sinks[name]
+		if s.Attempts == 0 {
+			continue
+		}
+		fmt.Printf("   %-9s %d results in %d writes (%.0fx fewer calls) | %d failed writes, %d batches lost\n",
+			name+":", s.Results, s.Attempts, s.ResultsPerCall(), s.Errors, s.Failures)
+		fmt.Printf("             flush p50 %-8s p95 %-8s p99 %-8s | batch p50 %d p95 %d mean %.0f\n",
+			formatMicros(s.Durations.QuantileUs(0.5)), formatMicros(s.Durations.QuantileUs(0.95)), formatMicros(s.Durations.QuantileUs(0.99)),
+			s.BatchSizes.Quantile(0.5), s.BatchSizes.Quantile(0.95), s.BatchSizes.Mean())
+	}
+}
+
+// printRetentionSummary shows the results list and what housekeeping trimmed
+func printRetentionSummary(retention ResultsRetention) {
+	fmt.Printf("\n📜 Results list: %d entries, %.1f MB\n", retention.Length, float64(retention.MemoryBytes)/(1<<20))
+	if retention.Trimmed > 0 {
+		fmt.Printf("   trimmed %d (%d archived), last at %s\n",
+			retention.Trimmed, retention.Archived, retention.LastTrim.Format(time.TimeOnly))
+	}
+}
+
+// printCacheSummary shows the merged cache metrics of every live worker
+func printCacheSummary(cache CacheMetrics) {
+	fmt.Println("\n🗄️  Cache lookup latency (all workers):")
+	tiers := make([]string, 0, len(cache.Latency))
+	for tier := range cache.Latency {
+		tiers = append(tiers, tier)
+	}
+	sort.Strings(tiers) // "l1", "l2", ... then "origin"
+	for _, tier := range tiers {
+		h := cache.Latency[tier]
+		if h.Count() == 0 {
+			continue
+		}
+		fmt.Printf("   %-7s p50 %-8s p95 %-8s p99 %-8s (%d lookups)\n", tier,
+			formatMicros(h.QuantileUs(0.5)), formatMicros(h.QuantileUs(0.95)), formatMicros(h.QuantileUs(0.99)), h.Count())
+	}
+	if len(cache.Tiers) > 0 {
+		fmt.Printf("   tiers: %s\n", strings.Join(cache.Tiers, ", "))
+	}
+	fmt.Printf("   evictions: %d | misses: %v | errors: %v | undecodable: %d\n",
+		cache.Evictions, cache.Misses, cache.Errors, cache.DecodeErrors)
+
+	if len(cache.Domains) > 0 {
+		fmt.Println("\n🌐 Hit ratio by domain (busiest first):")
+		for _, domain := range TopDomains(cache.Domains, 10) {
+			d := cache.Domains[domain]
+			fmt.Printf("   %-32s %5.1f%% of %d\n", domain, d.HitRatio()*100, d.Hits+d.Misses)
+		}
+	}
+}
+
 func formatDuration(d time.Duration) string {
 	h := int(d.Hours())
 	m := int(d.Minutes()) % 60
@@ -29,16 +29,37 @@ func main() {
 
 	log.Println("✅ Connected to Redis")
 
+	freshness, err := ParseFreshness(config.QueueFreshness)
+	if err != nil {
+		log.Fatal("invalid QUEUE_FRESHNESS: ", err)
+	}
+
+	// Target regions (REGIONS=eu-west,us-east); each one gets its own queue
+	regions := config.Regions
+	if len(regions) == 0 {
+		regions = []string{defaultRegion}
+	}
+
 	// Reset counters
 	rdb.Set(ctx, "success", 0, 0)
 	rdb.Set(ctx, "error", 0, 0)
 	rdb.Set(ctx, "processing", 0, 0)
+	rdb.Set(ctx, "partial_outage", 0, 0)
+	rdb.Set(ctx, "ssrf_blocked", 0, 0)
+	rdb.Del(ctx, "stampede:leases", "stampede:coalesced", "stampede:takeovers", "stampede:wait_timeouts")
+	for _, region := range regions {
+		rdb.Set(ctx, RegionCounterKey("success", region), 0, 0)
+		rdb.Set(ctx, RegionCounterKey("error", region), 0, 0)
+	}
 	rdb.Set(ctx, "cache_hit", 0, 0)
 	rdb.Set(ctx, "cache_miss", 0, 0)
 
 	// Clear old queue and results
-	rdb.Del(ctx, "url_queue")
+	for _, region := range regions {
+		rdb.Del(ctx, QueueKey(region))
+	}
 	rdb.Del(ctx, "results")
+	rdb.SAdd(ctx, regionsKey, regions)
 
 	log.Println("🗑️  Cleared previous data")
 
@@ -52,12 +73,26 @@ func main() {
 	count := 0
 	startTime := time.Now()
 
+	// Every URL in this run gets a check ID shared by all of its regions
+	runID := fmt.Sprintf("run-%d", startTime.Unix())
+	rdb.Set(ctx, "current_run", runID, 0)
+
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		url := scanner.Text()
 		if url != "" {
-			// Push to queue
-			rdb.LPush(ctx, "url_queue", url)
+			item := QueueItem{
+				CheckID:   fmt.Sprintf("%s:%d", runID, count),
+				RunID:     runID,
+				Attempt:   1,
+				URL:       url,
+				Freshness: freshness,
+			}
+
+			// Push to every targeted region's queue
+			for _, region := range regions {
+				rdb.LPush(ctx, QueueKey(region), item.Encode())
+			}
 			count++
 
 			// Progress every 10,000 URLs
@@ -74,10 +109,10 @@ func main() {
 	}
 
 	// Store total count
-	rdb.Set(ctx, "total_urls", count, 0)
+	rdb.Set(ctx, "total_urls", count*len(regions), 0)
 
 	elapsed := time.Since(startTime)
-	fmt.Printf("\n\n✅ Enqueued %d URLs in %.2f seconds\n", count, elapsed.Seconds())
+	fmt.Printf("\n\n✅ Enqueued %d URLs to %d region(s) %v in %.2f seconds\n", count, len(regions), regions, elapsed.Seconds())
 	fmt.Printf("📊 Average: %.0f URLs/sec\n", float64(count)/elapsed.Seconds())
 	fmt.Println("\n🚀 Ready to start workers!")
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Schema versions of the JSON in the results list (and the file and stdout
+// sinks):
+//
+//	1: a bare URLResult, written before the envelope existed
+//	2: ResultEnvelope
+//	3: idempotency_key added; derived from the other fields when reading 2
+//	4: idempotency_key identifies the check (check_id), no longer the URL
+//	   within a run; derived again when reading 3, whose keys collide
+//
+// A version only ever gains fields, and readers ignore fields they don't
+// know, so workers of mixed versions can share the list during a rolling
+// deploy. Renaming, removing or changing the meaning of a field needs a new
+// version and a case in DecodeResult. result_envelope_test.go checks every
+// fixture in testdata/results still decodes.
+const resultSchemaVersion = 4
+
+// ResultEnvelope carries a result with the check it answers. The metadata
+// is lifted out of the result, so it is only on the wire once.
+type ResultEnvelope struct {
+	SchemaVersion  int       `json:"schema_version"`
+	RunID          string    `json:"run_id,omitempty"`
+	Attempt        int       `json:"attempt,omitempty"`
+	CheckType      string    `json:"check_type,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	Result         URLResult `json:"result"`
+}
+
+// IdempotencyKey identifies one attempt at one check from one region, so
+// every delivery of it can be stored once. The check is its CheckID, shared
+// by the regions it was sent to: a run often checks the same URL many times,
+// and each of those checks is stored. Results without a check ID (older
+// producers) fall back to their run and URL; results from outside a run
+// (cache refreshes) have no key and are always stored.
+func IdempotencyKey(result URLResult) string {
+	var check string
+	switch {
+	case result.CheckID != "":
+		check = "check\x00" + result.CheckID
+	case result.RunID != "":
+		check = "run\x00" + result.RunID + "\x00" + result.URL
+	default:
+		return ""
+	}
+	region := result.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	sum := sha256.Sum256([]byte(check + "\x00" + region + "\x00" + strconv.Itoa(max(result.Attempt, 1))))
+	return hex.EncodeToString(sum[:16])
+}
+
+// EncodeResult wraps a result in the current envelope
+func EncodeResult(result URLResult) []byte {
+	env := ResultEnvelope{
+		SchemaVersion:  resultSchemaVersion,
+		RunID:          result.RunID,
+		Attempt:        result.Attempt,
+		CheckType:      result.CheckType,
+		IdempotencyKey: result.IdempotencyKey,
+		Result:         result,
+	}
+	env.Result.RunID, env.Result.Attempt, env.Result.CheckType, env.Result.IdempotencyKey = "", 0, "", ""
+	data, _ := json.Marshal(env)
+	return data
+}
+
+// DecodeResult reads any schema version. Bare results from before the
+// envelope come back without run, attempt, check type or idempotency key;
+// versions newer than this build are read for the fields it knows.
+func DecodeResult(data []byte) (URLResult, error) {
+	var env ResultEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return URLResult{}, err
+	}
+
+	switch {
+	case env.SchemaVersion == 0:
+		var result URLResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			return URLResult{}, err
+		}
+		if result.URL == "" {
+			return URLResult{}, fmt.Errorf("result has no URL")
+		}
+		return result, nil
+	case env.SchemaVersion < 0:
+		return URLResult{}, fmt.Errorf("invalid result schema version %d", env.SchemaVersion)
+	}
+
+	result := env.Result
+	if result.URL == "" {
+		return URLResult{}, fmt.Errorf("result (schema version %d) has no URL", env.SchemaVersion)
+	}
+	result.RunID, result.Attempt, result.CheckType = env.RunID, env.Attempt, env.CheckType
+	result.IdempotencyKey = env.IdempotencyKey
+	if result.IdempotencyKey == "" || env.SchemaVersion < 4 {
+		result.IdempotencyKey = IdempotencyKey(result)
+	}
+	return result, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wire compatibility tests for the results list and L2 entries. Every file
+// in testdata/ was written by some version of the workers and must keep
+// decoding; the current version's files must also match what this build
+// writes, byte for byte.
+//   go test result_envelope_test.go result_envelope.go cache_codec.go common.go
+//
+// After bumping resultSchemaVersion or cacheFormatVersion, add the new
+// version's files (never rewrite old ones) with:
+//   go test result_envelope_test.go result_envelope.go cache_codec.go common.go -update
+
+var update = flag.Bool("update", false, "add testdata fixtures for the current versions")
+
+func sampleResult() URLResult {
+	r := URLResult{
+		CheckID:   "run-1700000000:42",
+		RunID:     "run-1700000000",
+		Attempt:   2,
+		CheckType: CheckTypeDualStack,
+		URL:       "https://shop.example.com/checkout",
+		Status:    200,
+		Duration:  143,
+		CheckedAt: time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		WorkerID:  "worker-3",
+		Region:    "us-east",
+		Protocol:  "h2",
+		Families: []FamilyResult{
+			{Family: "ipv4", Status: 200, Duration: 120, Protocol: "h2", RemoteAddr: "93.184.216.34:443"},
+			{Family: "ipv6", Error: "connect: network is unreachable", Duration: 3},
+		},
+		PartialOutage: true,
+	}
+	r.IdempotencyKey = IdempotencyKey(r)
+	return r
+}
+
+// withoutCheck is the sample as written before results carried their check
+func withoutCheck(r URLResult) URLResult {
+	r.RunID, r.Attempt, r.CheckType, r.IdempotencyKey = "", 0, "", ""
+	return r
+}
+
+// outsideRun is the sample as a cache refresh checks it: no check at all
+func outsideRun(r URLResult) URLResult {
+	r = withoutCheck(r)
+	r.CheckID = ""
+	return r
+}
+
+// withoutKey is the sample as L2 stores it: the worker derives the
+// idempotency key again for every result it serves
+func withoutKey(r URLResult) URLResult {
+	r.IdempotencyKey = ""
+	return r
+}
+
+type fixture struct {
+	path string
+	want URLResult
+}
+
+func resultsPath(version int) string {
+	return filepath.Join("testdata", "results", fmt.Sprintf("v%d.json", version))
+}
+
+func cachePath(version byte) string {
+	return filepath.Join("testdata", "cache", fmt.Sprintf("v%d.hex", version))
+}
+
+// TestMain adds the fixtures before any test reads them
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if *update {
+		writeFixture(resultsPath(resultSchemaVersion), EncodeResult(sampleResult()))
+		writeFixture(cachePath(cacheFormatVersion), []byte(hex.EncodeToString(CacheCodec{}.Encode(sampleResult()))))
+	}
+	os.Exit(m.Run())
+}
+
+func TestEveryResultsVersionDecodes(t *testing.T) {
+	sample := sampleResult()
+	for _, f := range []fixture{
+		{resultsPath(1), withoutCheck(sample)}, // bare URLResult
+		{resultsPath(2), sample},               // idempotency key derived
+		{resultsPath(3), sample},               // idempotency key derived again
+		{resultsPath(4), sample},
+		{filepath.Join("testdata", "results", "future.json"), sample}, // fields this build doesn't know
+	} {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got, err := DecodeResult(bytes.TrimSpace(data)); err != nil || !sameResult(got, f.want) {
+			t.Errorf("%s: got %+v, %v", f.path, got, err)
+		}
+	}
+}
+
+func TestEveryCacheVersionDecodes(t *testing.T) {
+	sample := sampleResult()
+	for _, f := range []fixture{
+		{cachePath(1), withoutCheck(sample)},
+		{cachePath(2), withoutKey(sample)},
+	} {
+		data, err := readHex(f.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got, err := (CacheCodec{}).Decode(data); err != nil || !sameResult(got, f.want) {
+			t.Errorf("%s: got %+v, %v", f.path, got, err)
+		}
+	}
+}
+
+func TestCurrentFixturesMatchThisBuild(t *testing.T) {
+	sample := sampleResult()
+
+	want, err := os.ReadFile(resultsPath(resultSchemaVersion))
+	if err != nil || !bytes.Equal(EncodeResult(sample), bytes.TrimSpace(want)) {
+		t.Errorf("results list, schema version %d: this build writes %s (%v)", resultSchemaVersion, EncodeResult(sample), err)
+	}
+
+	wantBin, err := readHex(cachePath(cacheFormatVersion))
+	if err != nil || !bytes.Equal(CacheCodec{}.Encode(sample), wantBin) {
+		t.Errorf("L2 entry, format version %d: this build writes %x (%v)", cacheFormatVersion, CacheCodec{}.Encode(sample), err)
+	}
+}
+
+func TestEnvelopeCarriesTheCheckOnce(t *testing.T) {
+	sample := sampleResult()
+
+	var env map[string]json.RawMessage
+	json.Unmarshal(EncodeResult(sample), &env)
+	var inner map[string]json.RawMessage
+	json.Unmarshal(env["result"], &inner)
+	if string(env["run_id"]) != `"run-1700000000"` {
+		t.Errorf("run_id on the envelope is %s", env["run_id"])
+	}
+	for _, field := range []string{"run_id", "attempt", "idempotency_key"} {
+		if _, inside := inner[field]; inside {
+			t.Errorf("%s is inside the result too", field)
+		}
+	}
+
+	got, err := DecodeResult(EncodeResult(outsideRun(sample)))
+	if err != nil || !sameResult(got, outsideRun(sample)) {
+		t.Errorf("a result outside a run came back as %+v, %v", got, err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	sample := sampleResult()
+
+	redelivered := sample
+	redelivered.WorkerID, redelivered.CheckedAt = "worker-9", sample.CheckedAt.Add(time.Minute)
+	if IdempotencyKey(redelivered) != sample.IdempotencyKey {
+		t.Error("a redelivery got a different key")
+	}
+
+	// The same URL again in the same run is another check
+	again := sample
+	again.CheckID = "run-1700000000:43"
+	retried := sample
+	retried.Attempt++
+	elsewhere := sample
+	elsewhere.Region = "eu-west"
+	for name, other := range map[string]URLResult{"another check of the URL": again, "a new attempt": retried, "another region": elsewhere} {
+		if IdempotencyKey(other) == sample.IdempotencyKey {
+			t.Errorf("%s got the same key", name)
+		}
+	}
+
+	// Without a check ID only the run and URL are left to go on
+	noCheck := sample
+	noCheck.CheckID = ""
+	if key := IdempotencyKey(noCheck); key == "" || key == sample.IdempotencyKey {
+		t.Errorf("a result without a check ID got key %q", key)
+	}
+	if key := IdempotencyKey(outsideRun(sample)); key != "" {
+		t.Errorf("a result outside a run got key %q", key)
+	}
+}
+
+func TestDecodeRejectsNonResults(t *testing.T) {
+	for _, tc := range []struct{ name, data string }{
+		{"not JSON", `results`},
+		{"no URL", `{"status":200}`},
+		{"envelope, no URL", `{"schema_version":2,"result":{}}`},
+		{"negative version", `{"schema_version":-1,"result":{"url":"https://example.com"}}`},
+	} {
+		if _, err := DecodeResult([]byte(tc.data)); err == nil {
+			t.Errorf("%s: decoded", tc.name)
+		}
+	}
+
+	future := CacheCodec{}.Encode(sampleResult())
+	future[1] = cacheFormatVersion + 1
+	if _, err := (CacheCodec{}).Decode(future); !errors.Is(err, errCacheVersion) {
+		t.Errorf("L2 entry from a newer build: got %v, want errCacheVersion", err)
+	}
+}
+
+func readHex(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// writeFixture adds a fixture for a new version; existing ones are what older
+// workers really wrote, so they are never replaced
+func writeFixture(path string, data []byte) {
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("⏭️  %s already exists, leaving it alone\n", path)
+		return
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("📝 Wrote %s\n", path)
+}
+
+// sameResult compares times as instants, since L2 decodes them in local time
+func sameResult(a, b URLResult) bool {
+	if !a.CheckedAt.Equal(b.CheckedAt) {
+		return false
+	}
+	a.CheckedAt, b.CheckedAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Export formats
+const (
+	ExportCSV     = "csv"
+	ExportJSONL   = "jsonl"
+	ExportParquet = "parquet"
+)
+
+var exportContentTypes = map[string]string{
+	ExportCSV:     "text/csv; charset=utf-8",
+	ExportJSONL:   "application/x-ndjson",
+	ExportParquet: "application/vnd.apache.parquet",
+}
+
+// Rows per Parquet row group: the writer holds one group in memory
+const exportRowGroupRows = 100000
+
+// Status classes an export can be limited to. A non-2xx response is an error
+// to the worker too, so "error" only means no response was received at all.
+var exportStatusClasses = map[string]string{
+	"2xx":   "c.status_code BETWEEN 200 AND 299",
+	"3xx":   "c.status_code BETWEEN 300 AND 399",
+	"4xx":   "c.status_code BETWEEN 400 AND 499",
+	"5xx":   "c.status_code BETWEEN 500 AND 599",
+	"error": "c.status_code IS NULL",
+}
+
+// The host of a URL, lowercased and without a leading "www."
+const exportDomainSQL = `regexp_replace(lower(substring(u.url from '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^/:?#]+)')), '^www\.', '')`
+
+// ExportFilter selects checks to export; zero fields match everything.
+// From is inclusive and To exclusive.
+type ExportFilter struct {
+	RunID    string
+	From     time.Time
+	To       time.Time
+	Statuses []string
+	Domain   string
+	Tag      string
+	WorkerID string
+	Region   string
+}
+
+// ParseExportFilter reads a filter from query parameters: run, from, to
+// (RFC 3339 or a date), status (comma-separated classes), domain, tag,
+// worker and region
+func ParseExportFilter(values url.Values) (ExportFilter, error) {
+	filter := ExportFilter{
+		RunID:    values.Get("run"),
+		Domain:   strings.TrimPrefix(strings.ToLower(values.Get("domain")), "www."),
+		Tag:      values.Get("tag"),
+		WorkerID: values.Get("worker"),
+		Region:   values.Get("region"),
+	}
+
+	var err error
+	if filter.From, err = parseExportTime(values.Get("from")); err != nil {
+		return ExportFilter{}, fmt.Errorf("invalid from: %w", err)
+	}
+	if filter.To, err = parseExportTime(values.Get("to")); err != nil {
+		return ExportFilter{}, fmt.Errorf("invalid to: %w", err)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return ExportFilter{}, fmt.Errorf("from must be before to")
+	}
+
+	if status := values.Get("status"); status != "" {
+		for _, class := range strings.Split(status, ",") {
+			class = strings.ToLower(strings.TrimSpace(class))
+			if _, ok := exportStatusClasses[class]; !ok {
+				return ExportFilter{}, fmt.Errorf("invalid status class %q (want 2xx, 3xx, 4xx, 5xx or error)", class)
+			}
+			filter.Statuses = append(filter.Statuses, class)
+		}
+	}
+	return filter, nil
+}
+
+func parseExportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// ParseExportFormat defaults to CSV
+func ParseExportFormat(format string) (string, error) {
+	if format == "" {
+		return ExportCSV, nil
+	}
+	format = strings.ToLower(format)
+	if _, ok := exportContentTypes[format]; !ok {
+		return "", fmt.Errorf("unknown export format %q (want csv, jsonl or parquet)", format)
+	}
+	return format, nil
+}
+
+// ExportContentType is the MIME type of an export format
+func ExportContentType(format string) string {
+	return exportContentTypes[format]
+}
+
+// where builds the WHERE clause for the filter and its arguments
+func (f ExportFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.RunID != "" {
+		conds = append(conds, "c.run_id = "+arg(f.RunID))
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "c.checked_at >= "+arg(f.From))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "c.checked_at < "+arg(f.To))
+	}
+	if len(f.Statuses) > 0 {
+		classes := make([]string, len(f.Statuses))
+		for i, class := range f.Statuses {
+			classes[i] = exportStatusClasses[class]
+		}
+		conds = append(conds, "("+strings.Join(classes, " OR ")+")")
+	}
+	if f.Domain != "" {
+		conds = append(conds, exportDomainSQL+" = "+arg(f.Domain))
+	}
+	if f.Tag != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM url_tags ut JOIN tags t ON t.id = ut.tag_id WHERE ut.url_id = u.id AND t.name = "+arg(f.Tag)+")")
+	}
+	if f.WorkerID != "" {
+		conds = append(conds, "c.worker_id = "+arg(f.WorkerID))
+	}
+	if f.Region != "" {
+		conds = append(conds, "c.region = "+arg(f.Region))
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ExportRow is one check as exported, the same columns in every format.
+// StatusCode is 0 when no response was received.
+type ExportRow struct {
+	ID          int64     `json:"id" parquet:"id"`
+	CheckedAt   time.Time `json:"checked_at" parquet:"checked_at,timestamp(millisecond)"`
+	URL         string    `json:"url" parquet:"url,dict"`
+	Domain      string    `json:"domain" parquet:"domain,dict"`
+	Tags        []string  `json:"tags" parquet:"tags,list"`
+	StatusCode  int32     `json:"status_code,omitempty" parquet:"status_code"`
+	StatusClass string    `json:"status_class" parquet:"status_class,dict"`
+	DurationMs  int64     `json:"response_time_ms" parquet:"response_time_ms"`
+	Error       string    `json:"error,omitempty" parquet:"error"`
+	RunID       string    `json:"run_id,omitempty" parquet:"run_id,dict"`
+	WorkerID    string    `json:"worker_id,omitempty" parquet:"worker_id,dict"`
+	Region      string    `json:"region,omitempty" parquet:"region,dict"`
+}
+
+var exportCSVHeader = []string{"id", "checked_at", "url", "domain", "tags", "status_code", "status_class",
+	"response_time_ms", "error", "run_id", "worker_id", "region"}
+
+// StatusClassOf is the class ExportFilter matches a status code against
+func StatusClassOf(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// ExportCursor streams the result of an export query. Rows are read from
+// Postgres as they are written out, so an export of any size holds only
+// what the output format buffers.
+type ExportCursor struct {
+	rows   *sql.Rows
+	cancel context.CancelFunc
+}
+
+// QueryExport runs the query for filter, oldest check first, giving the
+// whole export up to timeout. It reads from the follower when it is healthy.
+func QueryExport(ctx context.Context, db *DBManager, filter ExportFilter, timeout time.Duration) (*ExportCursor, error) {
+	// With a deadline of its own, Query doesn't cancel the rows when it
+	// returns
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	where, args := filter.where()
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.checked_at, u.url, `+exportDomainSQL+`,
+			COALESCE((SELECT array_agg(t.name ORDER BY t.name) FROM url_tags ut JOIN tags t ON t.id = ut.tag_id WHERE ut.url_id = u.id), '{}'),
+			c.status_code, c.response_time_ms, c.error_message, c.run_id, c.worker_id, c.region
+		FROM checks c JOIN urls u ON u.id = c.url_id
+		`+where+`
+		ORDER BY c.checked_at, c.id`, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &ExportCursor{rows: rows, cancel: cancel}, nil
+}
+
+// Copy writes every row to w and closes it, returning how many it wrote
+func (c *ExportCursor) Copy(w ExportWriter) (int64, error) {
+	var n int64
+	for c.rows.Next() {
+		var (
+			row      ExportRow
+			domain   sql.NullString
+			status   sql.NullInt64
+			duration sql.NullInt64
+			errMsg   sql.NullString
+			runID    sql.NullString
+			workerID sql.NullString
+			region   sql.NullString
+		)
+		if err := c.rows.Scan(&row.ID, &row.CheckedAt, &row.URL, &domain, pq.Array(&row.Tags),
+			&status, &duration, &errMsg, &runID, &workerID, &region); err != nil {
+			return n, err
+		}
+		row.CheckedAt = row.CheckedAt.UTC()
+		row.Domain = domain.String
+		row.StatusCode = int32(status.Int64)
+		row.StatusClass = StatusClassOf(int(status.Int64))
+		row.DurationMs = duration.Int64
+		row.Error = errMsg.String
+		row.RunID, row.WorkerID, row.Region = runID.String, workerID.String, region.String
+
+		if err := w.Write(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := c.rows.Err(); err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+func (c *ExportCursor) Close() error {
+	defer c.cancel()
+	return c.rows.Close()
+}
+
+// ExportWriter encodes rows in one format. Close flushes what is buffered
+// and finishes the output, but leaves the underlying writer open.
+type ExportWriter interface {
+	Write(row ExportRow) error
+	Close() error
+}
+
+func NewExportWriter(format string, w io.Writer) (ExportWriter, error) {
+	switch format {
+	case ExportCSV:
+		out := csv.NewWriter(w)
+		if err := out.Write(exportCSVHeader); err != nil {
+			return nil, err
+		}
+		return &csvExportWriter{w: out}, nil
+	case ExportJSONL:
+		buf := bufio.NewWriterSize(w, 64*1024)
+		return &jsonlExportWriter{buf: buf, enc: json.NewEncoder(buf)}, nil
+	case ExportParquet:
+		return &parquetExportWriter{w: parquet.NewGenericWriter[ExportRow](w,
+			parquet.MaxRowsPerRowGroup(exportRowGroupRows),
+			parquet.Compression(&parquet.Zstd),
+		)}, nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+type csvExportWriter struct {
+	w    *csv.Writer
+	rows int
+}
+
+func (e *csvExportWriter) Write(row ExportRow) error {
+	status := ""
+	if row.StatusCode != 0 {
+		status = strconv.Itoa(int(row.StatusCode))
+	}
+	if err := e.w.Write([]string{
+		strconv.FormatInt(row.ID, 10),
+		row.CheckedAt.Format(time.RFC3339Nano),
+		row.URL,
+		row.Domain,
+		strings.Join(row.Tags, ";"),
+		status,
+		row.StatusClass,
+		strconv.FormatInt(row.DurationMs, 10),
+		row.Error,
+		row.RunID,
+		row.WorkerID,
+		row.Region,
+	}); err != nil {
+		return err
+	}
+
+	// csv.Writer only reports errors on Flush; flush now and then so a
+	// reader that went away stops the export early
+	e.rows++
+	if e.rows%1000 == 0 {
+		e.w.Flush()
+		return e.w.Error()
+	}
+	return nil
+}
+
+func (e *csvExportWriter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlExportWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *jsonlExportWriter) Write(row ExportRow) error {
+	return e.enc.Encode(row)
+}
+
+func (e *jsonlExportWriter) Close() error {
+	return e.buf.Flush()
+}
+
+// parquetExportWriter hands rows to the Parquet writer in small batches; it
+// starts a new row group every exportRowGroupRows rows
+type parquetExportWriter struct {
+	w     *parquet.GenericWriter[ExportRow]
+	batch []ExportRow
+}
+
+func (e *parquetExportWriter) Write(row ExportRow) error {
+	e.batch = append(e.batch, row)
+	if len(e.batch) < 1024 {
+		return nil
+	}
+	return e.flush()
+}
+
+func (e *parquetExportWriter) flush() error {
+	_, err := e.w.Write(e.batch)
+	e.batch = e.batch[:0]
+	return err
+}
+
+func (e *parquetExportWriter) Close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.w.Close()
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ResultSink is one destination for flushed result batches. Write may be
+// retried with the same batch, so it should either store all of it or fail.
+// Each sink is driven by a single goroutine of the fan-out.
+type ResultSink interface {
+	Name() string
+	Write(ctx context.Context, batch []URLResult) error
+	Close() error
+}
+
+// DedupingSink is a sink that skips results whose idempotency key it has
+// already stored, so a redelivered check or a replayed batch is written once
+type DedupingSink interface {
+	Duplicates() int64 // results skipped so far
+}
+
+// BuildResultSinks creates the sinks named in RESULT_SINKS: "redis" (results
+// list), "postgres" (checks table), "mongo" (one document per URL), "file"
+// (rotating JSONL) and "stdout". rdb and db are only needed by their sinks.
+func BuildResultSinks(names []string, config AppConfig, rdb *redis.Client, db *DBManager) ([]ResultSink, error) {
+	var sinks []ResultSink
+	for _, name := range names {
+		var sink ResultSink
+		switch name {
+		case "redis":
+			if rdb == nil {
+				return nil, fmt.Errorf("result sink redis needs a Redis client")
+			}
+			sink = &RedisListSink{rdb: rdb, key: resultsKey, seenTTL: time.Duration(config.IdempotencyTTL) * time.Second}
+		case "postgres":
+			if db == nil {
+				return nil, fmt.Errorf("result sink postgres needs a database")
+			}
+			sink = &PostgresSink{db: db}
+		case "mongo":
+			mongoSink, err := NewMongoSink(config.MongoURI, config.MongoDatabase, config.DedupWindow)
+			if err != nil {
+				return nil, err
+			}
+			sink = mongoSink
+		case "file":
+			sink = NewFileSink(config.ResultsFile, int64(config.ResultsFileMaxMB)<<20, config.ResultsFileKeep, config.DedupWindow)
+		case "stdout":
+			sink = &WriterSink{name: "stdout", w: os.Stdout, dedup: newDedupWindow(config.DedupWindow)}
+		default:
+			return nil, fmt.Errorf("unknown result sink %q (want redis, postgres, mongo, file or stdout)", name)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// dedupWindow remembers the idempotency keys a sink wrote most recently. It
+// catches what one process sees twice (a spool replaying a batch that was
+// written after all, a redelivery to the same worker), not duplicates
+// written by another worker.
+type dedupWindow struct {
+	keys       *lru.Cache[string, struct{}]
+	duplicates int64
+}
+
+// newDedupWindow returns nil, which dedupes nothing, for size 0
+func newDedupWindow(size int) *dedupWindow {
+	if size <= 0 {
+		return nil
+	}
+	keys, _ := lru.New[string, struct{}](size)
+	return &dedupWindow{keys: keys}
+}
+
+// filter drops results already written, or repeated within batch, and says
+// how many. Nothing is remembered or counted until the write succeeded and
+// remember is called, so a failed batch can be retried as is.
+func (w *dedupWindow) filter(batch []URLResult) (fresh []URLResult, duplicates int) {
+	if w == nil {
+		return batch, 0
+	}
+	fresh = make([]URLResult, 0, len(batch))
+	inBatch := make(map[string]bool)
+	for _, result := range batch {
+		key := result.IdempotencyKey
+		if key != "" && (inBatch[key] || w.keys.Contains(key)) {
+			duplicates++
+			continue
+		}
+		if key != "" {
+			inBatch[key] = true
+		}
+		fresh = append(fresh, result)
+	}
+	return fresh, duplicates
+}
+
+func (w *dedupWindow) remember(written []URLResult, duplicates int) {
+	if w == nil {
+		return
+	}
+	for _, result := range written {
+		if result.IdempotencyKey != "" {
+			w.keys.Add(result.IdempotencyKey, struct{}{})
+		}
+	}
+	atomic.AddInt64(&w.duplicates, int64(duplicates))
+}
+
+func (w *dedupWindow) Duplicates() int64 {
+	if w == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&w.duplicates)
+}
+
+// pushResultsScript pushes the results whose idempotency key is new to the
+// run's seen set, in one step so a result is never marked seen without
+// being pushed.
+//
+// KEYS: results list, then one seen set per run. ARGV: seen set TTL
+// (seconds), then per result the index of its seen set in KEYS (0 for
+// results without a key), its key and its envelope. Returns how many
+// results were duplicates.
+var pushResultsScript = redis.NewScript(`
+local duplicates = 0
+local push = {}
+for i = 2, #ARGV, 3 do
+	local set = tonumber(ARGV[i])
+	if set == 0 or redis.call("SADD", KEYS[set], ARGV[i + 1]) == 1 then
+		push[#push + 1] = ARGV[i + 2]
+	else
+		duplicates = duplicates + 1
+	end
+end
+for set = 2, #KEYS do
+	redis.call("EXPIRE", KEYS[set], ARGV[1])
+end
+for i = 1, #push, 1000 do
+	redis.call("LPUSH", KEYS[1], unpack(push, i, math.min(i + 999, #push)))
+end
+return duplicates
+`)
+
+// RedisListSink pushes results onto a Redis list, newest first. Results of
+// a run are deduped cluster-wide through the run's seen set, kept for
+// seenTTL after its last write.
+type RedisListSink struct {
+	rdb     *redis.Client
+	key     string
+	seenTTL time.Duration
+
+	duplicates int64
+}
+
+func (s *RedisListSink) Name() string      { return "redis" }
+func (s *RedisListSink) Close() error      { return nil }
+func (s *RedisListSink) Duplicates() int64 { return atomic.LoadInt64(&s.duplicates) }
+
+func seenKey(list, runID string) string {
+	return list + ":seen:" + runID
+}
+
+func (s *RedisListSink) Write(ctx context.Context, batch []URLResult) error {
+	keys := []string{s.key}
+	sets := make(map[string]int)
+	args := make([]interface{}, 1, 1+3*len(batch))
+	args[0] = int64(max(s.seenTTL/time.Second, 1))
+	for _, result := range batch {
+		set := 0
+		if result.IdempotencyKey != "" {
+			var ok bool
+			if set, ok = sets[result.RunID]; !ok {
+				keys = append(keys, seenKey(s.key, result.RunID))
+				set = len(keys)
+				sets[result.RunID] = set
+			}
+		}
+		args = append(args, strconv.Itoa(set), result.IdempotencyKey, EncodeResult(result))
+	}
+
+	duplicates, err := pushResultsScript.Run(ctx, s.rdb, keys, args...).Int64()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.duplicates, duplicates)
+	return nil
+}
+
+// PostgresSink stores results in the checks table, see SaveChecks
+type PostgresSink struct {
+	db *DBManager
+
+	duplicates int64
+}
+
+func (s *PostgresSink) Name() string      { return "postgres" }
+func (s *PostgresSink) Close() error      { return nil }
+func (s *PostgresSink) Duplicates() int64 { return atomic.LoadInt64(&s.duplicates) }
+
+func (s *PostgresSink) Write(ctx context.Context, batch []URLResult) error {
+	duplicates, err := SaveChecks(ctx, s.db, batch)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.duplicates, int64(duplicates))
+	return nil
+}
+
+// MongoSink appends checks to one URLDocument per URL, creating it on first
+// sight
+type MongoSink struct {
+	client *mongo.Client
+	coll   *mongo.Collection
+	dedup  *dedupWindow
+}
+
+func NewMongoSink(uri, database string, dedupWindow int) (*MongoSink, error) {
+	// Connect doesn't wait for the server; failures show up as write errors
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to MongoDB: %w", err)
+	}
+	return &MongoSink{client: client, coll: client.Database(database).Collection("urls"), dedup: newDedupWindow(dedupWindow)}, nil
+}
+
+func (s *MongoSink) Name() string      { return "mongo" }
+func (s *MongoSink) Duplicates() int64 { return s.dedup.Duplicates() }
+
+func (s *MongoSink) Close() error {
+	return s.client.Disconnect(context.Background())
+}
+
+func (s *MongoSink) Write(ctx context.Context, batch []URLResult) error {
+	batch, duplicates := s.dedup.filter(batch)
+	if len(batch) == 0 {
+		s.dedup.remember(nil, duplicates)
+		return nil
+	}
+
+	// One upsert per URL, pushing all of its checks in this batch at once
+	var order []string
+	checks := make(map[string][]CheckResult)
+	for _, result := range batch {
+		if _, seen := checks[result.URL]; !seen {
+			order = append(order, result.URL)
+		}
+		check := CheckResult{
+			Status:     result.Status,
+			DurationMs: int(result.Duration),
+			CheckedAt:  result.CheckedAt,
+			WorkerID:   result.WorkerID,
+			Tags:       []string{},
+
+			IdempotencyKey: result.IdempotencyKey,
+		}
+		if result.Error != "" {
+			errMsg := result.Error
+			check.ErrorMsg = &errMsg
+		}
+		checks[result.URL] = append(checks[result.URL], check)
+	}
+
+	models := make([]mongo.WriteModel, 0, len(order))
+	for _, u := range order {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"url": u}).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{"domain": urlDomain(u)},
+				"$push":        bson.M{"checks": bson.M{"$each": checks[u]}},
+			}).
+			SetUpsert(true))
+	}
+
+	if _, err := s.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return err
+	}
+	s.dedup.remember(batch, duplicates)
+	return nil
+}
+
+func urlDomain(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+		return strings.ToLower(strings.TrimPrefix(u.Hostname(), "www."))
+	}
+	return ""
+}
+
+// WriterSink writes one result envelope per line
+type WriterSink struct {
+	name  string
+	w     io.Writer
+	dedup *dedupWindow
+}
+
+func (s *WriterSink) Name() string      { return s.name }
+func (s *WriterSink) Close() error      { return nil }
+func (s *WriterSink) Duplicates() int64 { return s.dedup.Duplicates() }
+
+func (s *WriterSink) Write(ctx context.Context, batch []URLResult) error {
+	batch, duplicates := s.dedup.filter(batch)
+	if err := writeJSONLines(s.w, batch); err != nil {
+		return err
+	}
+	s.dedup.remember(batch, duplicates)
+	return nil
+}
+
+func writeJSONLines(w io.Writer, batch []URLResult) error {
+	buf := bufio.NewWriter(w)
+	for _, result := range batch {
+		buf.Write(EncodeResult(result))
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
+
+// FileSink appends JSON lines to path. Once the file would grow past
+// maxBytes it is rotated to path.1 (path.1 to path.2, and so on), keeping at
+// most keep old files.
+type FileSink struct {
+	path     string
+	maxBytes int64
+	keep     int
+	dedup    *dedupWindow
+
+	file *os.File
+	size int64
+}
+
+func NewFileSink(path string, maxBytes int64, keep, dedupWindow int) *FileSink {
+	return &FileSink{path: path, maxBytes: maxBytes, keep: keep, dedup: newDedupWindow(dedupWindow)}
+}
+
+func (s *FileSink) Name() string      { return "file" }
+func (s *FileSink) Duplicates() int64 { return s.dedup.Duplicates() }
+
+func (s *FileSink) Write(ctx context.Context, batch []URLResult) error {
+	batch, duplicates := s.dedup.filter(batch)
+	if len(batch) == 0 {
+		s.dedup.remember(nil, duplicates)
+		return nil
+	}
+
+	var buf strings.Builder
+	if err := writeJSONLines(&buf, batch); err != nil {
+		return err
+	}
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.WriteString(s.file, buf.String())
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	s.dedup.remember(batch, duplicates)
+	return nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	if s.keep <= 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	for i := s.keep - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", s.path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
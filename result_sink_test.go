@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Run with:
+//   go test result_sink_test.go result_sink.go result_envelope.go cache_codec.go check_store.go db_manager.go mongo_model.go config.go common.go
+//
+// The postgres and mongo cases use LEADER_DSN and MONGO_URI, and are skipped
+// when those servers aren't reachable.
+
+// sinkRun is the same URL checked twice in one run, then the first check
+// delivered again: the sink should store two results and skip one
+func sinkRun() (checks, redelivery []URLResult) {
+	runID := fmt.Sprintf("run-test-%d", time.Now().UnixNano())
+	first := URLResult{
+		CheckID:   runID + ":1",
+		RunID:     runID,
+		Attempt:   1,
+		URL:       "https://shop.example.com/checkout?" + runID,
+		Status:    200,
+		Duration:  120,
+		WorkerID:  "worker-1",
+		Region:    "us-east",
+		CheckedAt: time.Now().UTC(),
+	}
+	first.IdempotencyKey = IdempotencyKey(first)
+
+	second := first
+	second.CheckID = runID + ":2"
+	second.IdempotencyKey = IdempotencyKey(second)
+
+	again := first
+	again.WorkerID = "worker-2"
+
+	return []URLResult{first, second}, []URLResult{again}
+}
+
+// testSinkKeepsEveryCheck writes a run to sink and compares what stored
+// says is there
+func testSinkKeepsEveryCheck(t *testing.T, sink ResultSink, stored func(run URLResult) int) {
+	t.Helper()
+	checks, redelivery := sinkRun()
+
+	for _, batch := range [][]URLResult{checks, redelivery} {
+		if err := sink.Write(context.Background(), batch); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if n := stored(checks[0]); n != 2 {
+		t.Errorf("%s stored %d results, want both checks of the URL", sink.Name(), n)
+	}
+	if dups := sink.(DedupingSink).Duplicates(); dups != 1 {
+		t.Errorf("%s skipped %d duplicates, want the one redelivery", sink.Name(), dups)
+	}
+}
+
+func TestRedisSinkKeepsEveryCheck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	sink := &RedisListSink{rdb: rdb, key: resultsKey, seenTTL: time.Hour}
+	testSinkKeepsEveryCheck(t, sink, func(URLResult) int {
+		return int(rdb.LLen(context.Background(), resultsKey).Val())
+	})
+}
+
+func TestPostgresSinkKeepsEveryCheck(t *testing.T) {
+	config := LoadConfig()
+	db, err := NewDBManager(config.LeaderDSN, config.FollowerDSN)
+	if err != nil {
+		t.Skipf("no Postgres: %v", err)
+	}
+	defer db.Close()
+	pingCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := db.writeDB.PingContext(pingCtx); err != nil {
+		t.Skipf("no Postgres at LEADER_DSN: %v", err)
+	}
+
+	testSinkKeepsEveryCheck(t, &PostgresSink{db: db}, func(run URLResult) int {
+		ctx, cancel := context.WithTimeout(EnableReadYourWrites(context.Background()), 5*time.Second)
+		defer cancel()
+		t.Cleanup(func() {
+			db.Exec(context.Background(), `DELETE FROM checks WHERE run_id = $1`, run.RunID)
+			db.Exec(context.Background(), `DELETE FROM urls WHERE url = $1`, run.URL)
+		})
+
+		var n int
+		if err := db.QueryRow(ctx, `SELECT count(*) FROM checks WHERE run_id = $1`, run.RunID).Scan(&n); err != nil {
+			t.Fatalf("count: %v", err)
+		}
+		return n
+	})
+}
+
+func TestMongoSinkKeepsEveryCheck(t *testing.T) {
+	config := LoadConfig()
+	sink, err := NewMongoSink(config.MongoURI, config.MongoDatabase, 100)
+	if err != nil {
+		t.Skipf("no MongoDB: %v", err)
+	}
+	defer sink.Close()
+	pingCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := sink.client.Ping(pingCtx, nil); err != nil {
+		t.Skipf("no MongoDB at MONGO_URI: %v", err)
+	}
+
+	testSinkKeepsEveryCheck(t, sink, func(run URLResult) int {
+		t.Cleanup(func() { sink.coll.DeleteOne(context.Background(), bson.M{"url": run.URL}) })
+
+		var doc URLDocument
+		if err := sink.coll.FindOne(context.Background(), bson.M{"url": run.URL}).Decode(&doc); err != nil {
+			t.Fatalf("find: %v", err)
+		}
+		return len(doc.Checks)
+	})
+}
+
+func TestFileSinkKeepsEveryCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	sink := NewFileSink(path, 0, 0, 100)
+	defer sink.Close()
+
+	testSinkKeepsEveryCheck(t, sink, func(URLResult) int {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return countLines(data)
+	})
+}
+
+func TestWriterSinkKeepsEveryCheck(t *testing.T) {
+	var out bytes.Buffer
+	sink := &WriterSink{name: "stdout", w: &out, dedup: newDedupWindow(100)}
+
+	testSinkKeepsEveryCheck(t, sink, func(URLResult) int {
+		return countLines(out.Bytes())
+	})
+}
+
+func countLines(data []byte) int {
+	n := 0
+	for scanner := bufio.NewScanner(bytes.NewReader(data)); scanner.Scan(); {
+		n++
+	}
+	return n
+}
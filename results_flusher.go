@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackpressurePolicy is what Add does when the results buffer is full
+type BackpressurePolicy string
+
+const (
+	BackpressureBlock BackpressurePolicy = "block" // wait up to the block timeout, then drop
+	BackpressureDrop  BackpressurePolicy = "drop"  // drop right away
+	BackpressureSpill BackpressurePolicy = "spill" // write to disk, fed back in once there's room
+)
+
+// Spilled results are fed back in at most this many per tick, so a large
+// spill doesn't flood the sinks the moment pressure eases
+const spillReplayPerTick = 5000
+
+var errSpillPaused = errors.New("spill replay paused")
+
+type FlusherOptions struct {
+	QueueSize    int
+	Policy       BackpressurePolicy
+	BlockTimeout time.Duration
+	Spool        *Spool // required by the spill policy
+
+	// Bounds for the adaptive batching, see batchTuner. Equal bounds fix the
+	// batch size or the interval.
+	BatchMin    int
+	BatchMax    int
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+}
+
+// batchTuner picks the batch size that triggers a flush and the longest a
+// result waits for one. The interval is what it takes to gather BatchMin
+// results at the current arrival rate, but at least twice the slowest sink's
+// write time, and longer still while batches queue up for it, so flushes
+// don't outpace the sinks. The batch size is what arrives in one interval:
+// under steady load both triggers fire together, and a burst is flushed as
+// soon as it fills a batch.
+type batchTuner struct {
+	minBatch, maxBatch       int
+	minInterval, maxInterval time.Duration
+
+	rate     float64 // results/sec, moving average
+	batch    int
+	interval time.Duration
+}
+
+// newBatchTuner starts from 500 results or 2 seconds, the fixed values
+// before batching adapted, within the bounds
+func newBatchTuner(opts FlusherOptions) *batchTuner {
+	return &batchTuner{
+		minBatch:    opts.BatchMin,
+		maxBatch:    opts.BatchMax,
+		minInterval: opts.IntervalMin,
+		maxInterval: opts.IntervalMax,
+		batch:       min(max(500, opts.BatchMin), opts.BatchMax),
+		interval:    min(max(2*time.Second, opts.IntervalMin), opts.IntervalMax),
+	}
+}
+
+// observe takes the results that arrived over elapsed, and how the sinks are
+// keeping up, and sets the next batch size and interval
+func (t *batchTuner) observe(arrived int, elapsed, latency time.Duration, backlog int) {
+	if elapsed <= 0 {
+		return
+	}
+	t.rate += (float64(arrived)/elapsed.Seconds() - t.rate) * 0.3
+
+	interval := t.maxInterval
+	if t.rate > 0 {
+		interval = time.Duration(float64(t.minBatch) / t.rate * float64(time.Second))
+	}
+	interval = max(interval, 2*latency*time.Duration(1+backlog))
+	t.interval = min(max(interval, t.minInterval), t.maxInterval)
+	t.batch = min(max(int(t.rate*t.interval.Seconds()), t.minBatch), t.maxBatch)
+}
+
+// ResultsFlusher batches results and hands each batch to the result sinks
+type ResultsFlusher struct {
+	sinks        *SinkFanout
+	policy       BackpressurePolicy
+	blockTimeout time.Duration
+	spool        *Spool
+
+	resultsChan chan URLResult
+	stopChan    chan struct{}
+	wg          sync.WaitGroup
+
+	// Add holds smu for reading, so once Stop has set stopped no send to
+	// resultsChan is still under way
+	smu     sync.RWMutex
+	stopped bool
+
+	// The tuner belongs to run; tuned is its latest state for Metrics
+	tuner   *batchTuner
+	tmu     sync.Mutex
+	tuned   batchTuner
+	flushes int64
+
+	added         int64
+	full          int64
+	blockedNs     int64
+	blockTimeouts int64
+	dropped       int64
+	spilled       int64
+	replayed      int64
+}
+
+func NewResultsFlusher(sinks *SinkFanout, opts FlusherOptions) (*ResultsFlusher, error) {
+	switch opts.Policy {
+	case BackpressureBlock, BackpressureDrop:
+	case BackpressureSpill:
+		if opts.Spool == nil {
+			return nil, fmt.Errorf("backpressure policy spill needs SPOOL_DIR")
+		}
+	default:
+		return nil, fmt.Errorf("unknown backpressure policy %q (want block, drop or spill)", opts.Policy)
+	}
+	if opts.BatchMin < 1 || opts.BatchMax < opts.BatchMin {
+		return nil, fmt.Errorf("invalid batch size bounds %d-%d", opts.BatchMin, opts.BatchMax)
+	}
+	if opts.IntervalMin <= 0 || opts.IntervalMax < opts.IntervalMin {
+		return nil, fmt.Errorf("invalid flush interval bounds %s-%s", opts.IntervalMin, opts.IntervalMax)
+	}
+
+	f := &ResultsFlusher{
+		sinks:        sinks,
+		policy:       opts.Policy,
+		blockTimeout: opts.BlockTimeout,
+		spool:        opts.Spool,
+		resultsChan:  make(chan URLResult, opts.QueueSize),
+		stopChan:     make(chan struct{}),
+		tuner:        newBatchTuner(opts),
+	}
+	f.tuned = *f.tuner
+	f.wg.Add(1)
+	go f.run()
+	return f, nil
+}
+
+// Add buffers a result for the next batch. When the buffer is full the
+// backpressure policy decides whether the caller waits, or the result is
+// dropped or spilled to disk; Add never writes to a sink itself. Results
+// added after Stop are dropped.
+func (f *ResultsFlusher) Add(ctx context.Context, result URLResult) {
+	atomic.AddInt64(&f.added, 1)
+
+	f.smu.RLock()
+	defer f.smu.RUnlock()
+	if f.stopped {
+		f.drop("stopped")
+		return
+	}
+
+	select {
+	case f.resultsChan <- result:
+		//Buffer successfully
+		return
+	default:
+	}
+	atomic.AddInt64(&f.full, 1)
+
+	switch f.policy {
+	case BackpressureBlock:
+		start := time.Now()
+		timer := time.NewTimer(f.blockTimeout)
+		defer timer.Stop()
+
+		select {
+		case f.resultsChan <- result:
+			atomic.AddInt64(&f.blockedNs, int64(time.Since(start)))
+			return
+		case <-timer.C:
+			atomic.AddInt64(&f.blockTimeouts, 1)
+		case <-ctx.Done():
+		}
+		atomic.AddInt64(&f.blockedNs, int64(time.Since(start)))
+		f.drop("still full after blocking")
+
+	case BackpressureSpill:
+		if err := f.spool.Append([]URLResult{result}); err != nil {
+			log.Printf("❌ Spilling result failed: %v\n", err)
+			f.drop("spill failed")
+			return
+		}
+		atomic.AddInt64(&f.spilled, 1)
+
+	default:
+		f.drop("full")
+	}
+}
+
+// drop counts a lost result, logging the first and then every 1000th so a
+// sustained overload doesn't flood the log
+func (f *ResultsFlusher) drop(reason string) {
+	if n := atomic.AddInt64(&f.dropped, 1); n == 1 || n%1000 == 0 {
+		log.Printf("⚠️ Flusher buffer %s, dropped %d results so far\n", reason, n)
+	}
+}
+
+func (f *ResultsFlusher) run() {
+	defer f.wg.Done()
+
+	tuner := f.tuner
+	batch := make([]URLResult, 0, tuner.batch)
+	timer := time.NewTimer(tuner.interval)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Sinks keep the batch until they've written it, so start a new one
+		f.sinks.Write(batch)
+		atomic.AddInt64(&f.flushes, 1)
+		log.Printf("📦 Flushed %d results to %d sinks\n", len(batch), len(f.sinks.runners))
+		batch = make([]URLResult, 0, tuner.batch)
+	}
+
+	// adapt retunes after every flush by size or time, from the results that
+	// arrived since the last one (spilled ones fed back in don't count)
+	arrived, lastAdapt := 0, time.Now()
+	adapt := func() {
+		latency, backlog := f.sinks.Pressure()
+		now := time.Now()
+		tuner.observe(arrived, now.Sub(lastAdapt), latency, backlog)
+		arrived, lastAdapt = 0, now
+		timer.Reset(tuner.interval)
+
+		f.tmu.Lock()
+		f.tuned = *tuner
+		f.tmu.Unlock()
+	}
+
+	// unspill feeds spilled results back into batches, up to limit (0 for
+	// all of them)
+	unspill := func(limit int) {
+		if f.spool == nil || !f.spool.Pending() {
+			return
+		}
+		taken := 0
+		_, err := f.spool.Replay(func(spilled []URLResult) error {
+			if limit > 0 && taken >= limit {
+				return errSpillPaused
+			}
+			batch = append(batch, spilled...)
+			taken += len(spilled)
+			if len(batch) >= tuner.batch {
+				flush()
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errSpillPaused) {
+			log.Printf("❌ Reading spilled results failed: %v\n", err)
+		}
+		atomic.AddInt64(&f.replayed, int64(taken))
+	}
+
+	for {
+		select {
+		case result := <-f.resultsChan:
+			batch = append(batch, result)
+			arrived++
+
+			if len(batch) >= tuner.batch {
+				flush()
+				adapt()
+			}
+
+		case <-timer.C:
+			flush()
+			// Only once the buffer has room again
+			if len(f.resultsChan) < cap(f.resultsChan)/2 {
+				unspill(spillReplayPerTick)
+				flush()
+			}
+			adapt()
+		case <-f.stopChan:
+			// Whatever is still buffered goes out with the last batches
+			for len(f.resultsChan) > 0 {
+				batch = append(batch, <-f.resultsChan)
+				if len(batch) >= tuner.batch {
+					flush()
+				}
+			}
+			flush()
+			unspill(0)
+			flush()
+			return
+		}
+	}
+}
+
+// Stop flushes everything added so far and stops the sinks. It waits for an
+// Add that is blocked on a full buffer, at most BlockTimeout.
+func (f *ResultsFlusher) Stop() {
+	f.smu.Lock()
+	if f.stopped {
+		f.smu.Unlock()
+		return
+	}
+	f.stopped = true
+	f.smu.Unlock()
+
+	close(f.stopChan)
+	f.wg.Wait()
+	close(f.resultsChan)
+	f.sinks.Stop()
+	if f.spool != nil {
+		f.spool.Close()
+	}
+}
+
+func (f *ResultsFlusher) Metrics(workerID string) FlusherMetrics {
+	var duplicates int64
+	sinks := make(map[string]SinkFlushMetrics)
+	for _, s := range f.sinks.Stats() {
+		duplicates += s.Duplicates
+		sinks[s.Name] = SinkFlushMetrics{
+			Batches:    s.Batches,
+			Results:    s.Results,
+			Attempts:   s.Attempts,
+			Errors:     s.Errors,
+			Failures:   s.Failures,
+			Durations:  s.Durations,
+			BatchSizes: s.BatchSizes,
+		}
+	}
+
+	f.tmu.Lock()
+	tuned := f.tuned
+	f.tmu.Unlock()
+
+	return FlusherMetrics{
+		WorkerID:      workerID,
+		UpdatedAt:     time.Now(),
+		Policy:        string(f.policy),
+		Depth:         len(f.resultsChan),
+		Capacity:      cap(f.resultsChan),
+		Added:         atomic.LoadInt64(&f.added),
+		Full:          atomic.LoadInt64(&f.full),
+		BlockedMs:     time.Duration(atomic.LoadInt64(&f.blockedNs)).Milliseconds(),
+		BlockTimeouts: atomic.LoadInt64(&f.blockTimeouts),
+		Dropped:       atomic.LoadInt64(&f.dropped),
+		Spilled:       atomic.LoadInt64(&f.spilled),
+		Replayed:      atomic.LoadInt64(&f.replayed),
+		Duplicates:    duplicates,
+		Flushes:       atomic.LoadInt64(&f.flushes),
+		BatchTarget:   tuned.batch,
+		IntervalMs:    tuned.interval.Milliseconds(),
+		ArrivalRate:   tuned.rate,
+		Sinks:         sinks,
+	}
+}
+
+func (f *ResultsFlusher) PrintStats() {
+	m := f.Metrics("")
+	fmt.Printf("\n"+
+		"════════════════════════════════════════\n"+
+		"RESULTS FLUSHER (policy: %s)\n"+
+		"════════════════════════════════════════\n"+
+		"Buffer:   %d / %d\n"+
+		"Added:    %d (%d found the buffer full)\n"+
+		"Blocked:  %s total, %d timeouts\n"+
+		"Dropped:  %d | Spilled: %d | Fed back: %d\n"+
+		"Batching: %d flushes | now %d results or %s | %.0f results/sec\n",
+		m.Policy, m.Depth, m.Capacity, m.Added, m.Full,
+		time.Duration(m.BlockedMs)*time.Millisecond, m.BlockTimeouts,
+		m.Dropped, m.Spilled, m.Replayed,
+		m.Flushes, m.BatchTarget, time.Duration(m.IntervalMs)*time.Millisecond, m.ArrivalRate,
+	)
+	f.sinks.PrintStats()
+}
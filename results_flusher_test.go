@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with:
+//   go test results_flusher_test.go sink_fanout_test.go spool_test.go results_flusher.go flusher_metrics.go sink_fanout.go spool.go result_sink.go result_envelope.go cache_codec.go cache_metrics.go check_store.go db_manager.go mongo_model.go config.go common.go
+
+func newTestFlusher(t *testing.T, sink ResultSink, policy BackpressurePolicy) *ResultsFlusher {
+	t.Helper()
+	fanout, err := NewSinkFanout([]ResultSink{sink}, 10, 0, time.Second, SpoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flusher, err := NewResultsFlusher(fanout, FlusherOptions{
+		QueueSize:    4,
+		Policy:       policy,
+		BlockTimeout: 50 * time.Millisecond,
+		BatchMin:     1,
+		BatchMax:     100,
+		IntervalMin:  10 * time.Millisecond,
+		IntervalMax:  time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flusher
+}
+
+// A signal stopping the flusher while the worker loop still adds results
+// used to panic with a send on the closed results channel
+func TestFlusherAddDuringStop(t *testing.T) {
+	for _, policy := range []BackpressurePolicy{BackpressureBlock, BackpressureDrop} {
+		sink := &recordingSink{}
+		flusher := newTestFlusher(t, sink, policy)
+
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 200 {
+					flusher.Add(context.Background(), URLResult{URL: "https://example.com/"})
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		flusher.Stop()
+		wg.Wait()
+
+		m := flusher.Metrics("worker-1")
+		if got := int64(len(sink.written())) + m.Dropped; got != m.Added || m.Added != 800 {
+			t.Errorf("%s: %d added, %d written + dropped; want every result accounted for", policy, m.Added, got)
+		}
+	}
+}
+
+func TestFlusherDropsAfterStop(t *testing.T) {
+	sink := &recordingSink{}
+	flusher := newTestFlusher(t, sink, BackpressureBlock)
+	flusher.Add(context.Background(), URLResult{URL: "https://example.com/a"})
+	flusher.Stop()
+	flusher.Stop()
+	flusher.Add(context.Background(), URLResult{URL: "https://example.com/b"})
+
+	if got := sink.written(); !sameURLs(got, []string{"https://example.com/a"}) {
+		t.Errorf("sink got %v, want only what was added before Stop", got)
+	}
+	if m := flusher.Metrics("worker-1"); m.Dropped != 1 {
+		t.Errorf("%d dropped, want the result added after Stop", m.Dropped)
+	}
+}
+
+func testTuner() *batchTuner {
+	return newBatchTuner(FlusherOptions{
+		BatchMin:    100,
+		BatchMax:    5000,
+		IntervalMin: 500 * time.Millisecond,
+		IntervalMax: 5 * time.Second,
+	})
+}
+
+// about allows for the moving average never quite reaching the rate
+func about(got, want int) bool {
+	return got >= want*99/100 && got <= want*101/100
+}
+
+// settle feeds the tuner a steady rate until its moving average catches up
+func settle(tuner *batchTuner, perSecond int, latency time.Duration, backlog int) {
+	for range 50 {
+		tuner.observe(perSecond, time.Second, latency, backlog)
+	}
+}
+
+func TestBatchTunerStartsWithinBounds(t *testing.T) {
+	tuner := newBatchTuner(FlusherOptions{BatchMin: 10, BatchMax: 100, IntervalMin: 5 * time.Second, IntervalMax: 10 * time.Second})
+	if tuner.batch != 100 || tuner.interval != 5*time.Second {
+		t.Errorf("started at %d results or %s, want 500/2s clamped to 100/5s", tuner.batch, tuner.interval)
+	}
+}
+
+func TestBatchTunerFollowsTheArrivalRate(t *testing.T) {
+	tuner := testTuner()
+
+	// 1000/s: BatchMin arrives in 100ms, below IntervalMin
+	settle(tuner, 1000, 0, 0)
+	if tuner.interval != 500*time.Millisecond || !about(tuner.batch, 500) {
+		t.Errorf("at 1000/s: %d results or %s, want 500 or 500ms", tuner.batch, tuner.interval)
+	}
+
+	// 50/s: BatchMin takes 2s to arrive
+	settle(tuner, 50, 0, 0)
+	if d := tuner.interval - 2*time.Second; d < -50*time.Millisecond || d > 50*time.Millisecond {
+		t.Errorf("at 50/s: interval %s, want about 2s", tuner.interval)
+	}
+	if tuner.batch != 100 {
+		t.Errorf("at 50/s: batch %d, want BatchMin", tuner.batch)
+	}
+
+	// Idle: wait as long as allowed
+	settle(tuner, 0, 0, 0)
+	if tuner.interval != 5*time.Second || tuner.batch != 100 {
+		t.Errorf("idle: %d results or %s, want 100 or 5s", tuner.batch, tuner.interval)
+	}
+
+	// A flood: batches stop at BatchMax
+	settle(tuner, 100000, 0, 0)
+	if tuner.interval != 500*time.Millisecond || !about(tuner.batch, 5000) {
+		t.Errorf("at 100000/s: %d results or %s, want 5000 or 500ms", tuner.batch, tuner.interval)
+	}
+}
+
+func TestBatchTunerWaitsForSlowSinks(t *testing.T) {
+	tuner := testTuner()
+
+	// A 400ms write sets a floor of twice that, above what the rate asks for
+	settle(tuner, 1000, 400*time.Millisecond, 0)
+	if tuner.interval != 800*time.Millisecond || !about(tuner.batch, 800) {
+		t.Errorf("400ms writes: %d results or %s, want 800 or 800ms", tuner.batch, tuner.interval)
+	}
+
+	// Batches queuing up for the sink stretch it further
+	settle(tuner, 1000, 400*time.Millisecond, 2)
+	if tuner.interval != 2400*time.Millisecond || !about(tuner.batch, 2400) {
+		t.Errorf("400ms writes, 2 queued: %d results or %s, want 2400 or 2.4s", tuner.batch, tuner.interval)
+	}
+
+	// Never past IntervalMax
+	settle(tuner, 1000, 2*time.Second, 5)
+	if tuner.interval != 5*time.Second || !about(tuner.batch, 5000) {
+		t.Errorf("very slow sink: %d results or %s, want 5000 or 5s", tuner.batch, tuner.interval)
+	}
+}
+
+func TestBatchTunerIgnoresEmptyIntervals(t *testing.T) {
+	tuner := testTuner()
+	before := *tuner
+	tuner.observe(100, 0, 0, 0)
+	if *tuner != before {
+		t.Errorf("observe with no elapsed time changed the tuner: %+v", *tuner)
+	}
+}
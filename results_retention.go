@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// One worker at a time trims the results list
+	resultsHousekeepingLockKey = "results:housekeeping"
+
+	// Entries moved per round trip while trimming
+	resultsTrimChunk = 1000
+)
+
+// trimResultsScript drops the ARGV[2] oldest entries of the list in KEYS[2]
+// if ARGV[1] still holds the housekeeping lease in KEYS[1]. Returns 0 when
+// the lease was lost: another worker may be trimming the same tail, and
+// trimming it again would drop entries nobody archived.
+var trimResultsScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("LTRIM", KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+return 1
+`)
+
+// ResultsHousekeeper keeps the results list at its newest keep entries.
+// Older entries go to the archive sink first when there is one; if the
+// archive fails they stay in the list until the next run, so nothing is
+// dropped unarchived.
+type ResultsHousekeeper struct {
+	rdb      *redis.Client
+	keep     int64
+	archive  ResultSink // nil drops trimmed entries
+	owner    string
+	interval time.Duration
+}
+
+func NewResultsHousekeeper(rdb *redis.Client, keep int, archive ResultSink, owner string, interval time.Duration) *ResultsHousekeeper {
+	return &ResultsHousekeeper{rdb: rdb, keep: int64(keep), archive: archive, owner: owner, interval: interval}
+}
+
+// Run trims every interval until ctx is done
+func (h *ResultsHousekeeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			trimmed, archived, err := h.Trim(ctx)
+			if err != nil {
+				log.Printf("⚠️ Results housekeeping: %v\n", err)
+			}
+			if trimmed > 0 {
+				log.Printf("🧹 Trimmed %d old results (%d archived)\n", trimmed, archived)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Trim removes everything past the newest keep entries, oldest first, if no
+// other worker is doing it right now. Workers only LPUSH, so the oldest
+// entries sit still at the tail while new ones arrive at the head.
+func (h *ResultsHousekeeper) Trim(ctx context.Context) (trimmed, archived int, err error) {
+	if h.keep <= 0 {
+		return 0, 0, nil
+	}
+
+	lease := 2 * h.interval
+	acquired, err := h.rdb.SetNX(ctx, resultsHousekeepingLockKey, h.owner, lease).Result()
+	if err != nil || !acquired {
+		return 0, 0, err
+	}
+	defer releaseLeaseScript.Run(ctx, h.rdb, []string{resultsHousekeepingLockKey}, h.owner)
+
+	// Archiving a large backlog can outlast the lease, so keep renewing it
+	// until Trim returns
+	renewCtx, stopRenewing := context.WithCancel(ctx)
+	defer stopRenewing()
+	go h.keepLease(renewCtx, lease)
+
+	defer func() {
+		if trimmed > 0 {
+			pipe := h.rdb.Pipeline()
+			pipe.HIncrBy(ctx, resultsRetentionKey, "trimmed", int64(trimmed))
+			pipe.HIncrBy(ctx, resultsRetentionKey, "archived", int64(archived))
+			pipe.HSet(ctx, resultsRetentionKey, "last_trim", time.Now().Unix())
+			pipe.Exec(ctx)
+		}
+	}()
+
+	length, err := h.rdb.LLen(ctx, resultsKey).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for excess := length - h.keep; excess > 0; {
+		n := min(excess, resultsTrimChunk)
+
+		// Newest of the chunk first, oldest last
+		raw, err := h.rdb.LRange(ctx, resultsKey, -n, -1).Result()
+		if err != nil {
+			return trimmed, archived, err
+		}
+
+		if h.archive != nil {
+			batch := make([]URLResult, 0, len(raw))
+			for i := len(raw) - 1; i >= 0; i-- {
+				if result, err := DecodeResult([]byte(raw[i])); err == nil {
+					batch = append(batch, result)
+				}
+			}
+			archiveCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err = h.archive.Write(archiveCtx, batch)
+			cancel()
+			if err != nil {
+				return trimmed, archived, fmt.Errorf("archive to %s failed, keeping %d results: %w", h.archive.Name(), excess, err)
+			}
+			archived += len(batch)
+		}
+
+		held, err := trimResultsScript.Run(ctx, h.rdb, []string{resultsHousekeepingLockKey, resultsKey}, h.owner, n).Int()
+		if err != nil {
+			return trimmed, archived, err
+		}
+		if held == 0 {
+			return trimmed, archived, fmt.Errorf("lost the housekeeping lock, leaving %d results for the next run", excess)
+		}
+		trimmed += int(n)
+		excess -= n
+	}
+	return trimmed, archived, nil
+}
+
+// keepLease renews the housekeeping lease every third of its duration until
+// ctx is done
+func (h *ResultsHousekeeper) keepLease(ctx context.Context, lease time.Duration) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			renewLeaseScript.Run(ctx, h.rdb, []string{resultsHousekeepingLockKey}, h.owner, lease.Milliseconds())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Run with:
+//   go test results_retention_test.go results_retention.go distributed_stampede.go result_sink.go result_envelope.go cache_codec.go check_store.go db_manager.go mongo_model.go config.go common.go
+
+// archiveFunc is an archive sink that calls write for every batch
+type archiveFunc func(batch []URLResult) error
+
+func (f archiveFunc) Name() string { return "test" }
+func (f archiveFunc) Close() error { return nil }
+func (f archiveFunc) Write(ctx context.Context, batch []URLResult) error {
+	return f(batch)
+}
+
+func newResultsList(t *testing.T, n int) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	for i := 0; i < n; i++ {
+		mr.Lpush(resultsKey, string(EncodeResult(URLResult{URL: "https://example.com/", Status: 200})))
+	}
+	return mr, rdb
+}
+
+func TestTrimKeepsTheNewest(t *testing.T) {
+	mr, rdb := newResultsList(t, 2500)
+	var archived int
+	archive := archiveFunc(func(batch []URLResult) error {
+		archived += len(batch)
+		return nil
+	})
+
+	trimmed, _, err := NewResultsHousekeeper(rdb, 1000, archive, "worker-1", time.Minute).Trim(context.Background())
+	if err != nil || trimmed != 1500 || archived != 1500 {
+		t.Errorf("trimmed %d, archived %d, %v; want 1500 of each", trimmed, archived, err)
+	}
+	if n, _ := rdb.LLen(context.Background(), resultsKey).Result(); n != 1000 {
+		t.Errorf("%d results left, want 1000", n)
+	}
+	if mr.Exists(resultsHousekeepingLockKey) {
+		t.Error("the lock is still held after Trim")
+	}
+}
+
+func TestTrimStopsWhenTheLockIsLost(t *testing.T) {
+	mr, rdb := newResultsList(t, 2500)
+
+	// The lease runs out while the first chunk is archived, and another
+	// worker takes over
+	archive := archiveFunc(func(batch []URLResult) error {
+		mr.Set(resultsHousekeepingLockKey, "worker-2")
+		return nil
+	})
+
+	trimmed, _, err := NewResultsHousekeeper(rdb, 1000, archive, "worker-1", time.Minute).Trim(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "lost the housekeeping lock") || trimmed != 0 {
+		t.Errorf("trimmed %d, %v; want 0 and a lost lock", trimmed, err)
+	}
+	if n, _ := rdb.LLen(context.Background(), resultsKey).Result(); n != 2500 {
+		t.Errorf("%d results left, want all 2500", n)
+	}
+	if owner, _ := mr.Get(resultsHousekeepingLockKey); owner != "worker-2" {
+		t.Errorf("the new holder's lock was released (now %q)", owner)
+	}
+}
+
+func TestTrimRenewsTheLease(t *testing.T) {
+	mr, rdb := newResultsList(t, 1500)
+
+	// A 300ms lease, renewed every 100ms, while archiving takes 600ms
+	archive := archiveFunc(func(batch []URLResult) error {
+		for i := 0; i < 4; i++ {
+			time.Sleep(150 * time.Millisecond)
+			mr.FastForward(150 * time.Millisecond)
+		}
+		return nil
+	})
+
+	trimmed, _, err := NewResultsHousekeeper(rdb, 1000, archive, "worker-1", 150*time.Millisecond).Trim(context.Background())
+	if err != nil || trimmed != 500 {
+		t.Errorf("trimmed %d, %v; want 500", trimmed, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	securityAuditLastKey        = "security_audit:last"
+	securityAuditRegressionsKey = "security_audit:regressions"
+
+	// One year, the minimum max-age accepted by the HSTS preload list
+	hstsMinMaxAge = 31536000
+)
+
+type SecurityRegression struct {
+	URL           string        `json:"url"`
+	PreviousScore int           `json:"previous_score"`
+	PreviousAt    time.Time     `json:"previous_audited_at"`
+	Current       SecurityAudit `json:"current"`
+}
+
+var severityPenalty = map[string]int{
+	"high":   20,
+	"medium": 10,
+	"low":    5,
+}
+
+func (a *SecurityAudit) add(check, severity, format string, args ...any) {
+	a.Findings = append(a.Findings, SecurityFinding{
+		Check:    check,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	a.Score -= severityPenalty[severity]
+}
+
+// AuditSecurityHeaders scores a response's security headers and cookie flags.
+// Every check starts at 100 and each finding subtracts by severity.
+func AuditSecurityHeaders(resp *http.Response) *SecurityAudit {
+	audit := &SecurityAudit{Score: 100, AuditedAt: time.Now()}
+	h := resp.Header
+
+	// HSTS only means something over TLS
+	if resp.TLS != nil {
+		auditHSTS(audit, h.Get("Strict-Transport-Security"))
+	}
+
+	csp := h.Get("Content-Security-Policy")
+	if csp == "" {
+		audit.add("csp", "high", "Content-Security-Policy header missing")
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(h.Get("X-Content-Type-Options")), "nosniff") {
+		audit.add("x-content-type-options", "medium", "X-Content-Type-Options is not set to nosniff")
+	}
+
+	if h.Get("X-Frame-Options") == "" && !strings.Contains(csp, "frame-ancestors") {
+		audit.add("x-frame-options", "medium", "X-Frame-Options missing and CSP has no frame-ancestors")
+	}
+
+	if h.Get("Referrer-Policy") == "" {
+		audit.add("referrer-policy", "low", "Referrer-Policy header missing")
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if !cookie.Secure {
+			audit.add("cookie", "medium", "cookie %q missing Secure flag", cookie.Name)
+		}
+		if !cookie.HttpOnly {
+			audit.add("cookie", "low", "cookie %q missing HttpOnly flag", cookie.Name)
+		}
+		switch cookie.SameSite {
+		// An absent attribute parses as the zero value, not SameSiteDefaultMode
+		case 0, http.SameSiteDefaultMode:
+			audit.add("cookie", "low", "cookie %q has no SameSite attribute", cookie.Name)
+		case http.SameSiteNoneMode:
+			if !cookie.Secure {
+				audit.add("cookie", "medium", "cookie %q uses SameSite=None without Secure", cookie.Name)
+			}
+		}
+	}
+
+	if audit.Score < 0 {
+		audit.Score = 0
+	}
+	return audit
+}
+
+func auditHSTS(audit *SecurityAudit, value string) {
+	if value == "" {
+		audit.add("hsts", "high", "Strict-Transport-Security header missing")
+		return
+	}
+
+	maxAge := -1
+	preload := false
+	for _, directive := range strings.Split(value, ";") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		switch {
+		case strings.HasPrefix(directive, "max-age="):
+			if n, err := strconv.Atoi(strings.Trim(directive[len("max-age="):], `"`)); err == nil {
+				maxAge = n
+			}
+		case directive == "preload":
+			preload = true
+		}
+	}
+
+	if maxAge < 0 {
+		audit.add("hsts", "high", "Strict-Transport-Security has no valid max-age")
+	} else if maxAge < hstsMinMaxAge {
+		audit.add("hsts", "medium", "HSTS max-age %d is below one year", maxAge)
+	}
+	if !preload {
+		audit.add("hsts", "low", "HSTS preload directive missing")
+	}
+}
+
+// RecordSecurityAudit stores the latest audit for a URL and tracks whether its
+// score dropped compared to the previous one.
+func RecordSecurityAudit(ctx context.Context, rdb *redis.Client, url string, audit *SecurityAudit) error {
+	data, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+
+	prevData, err := rdb.HGet(ctx, securityAuditLastKey, url).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	if err := rdb.HSet(ctx, securityAuditLastKey, url, data).Err(); err != nil {
+		return err
+	}
+
+	if prevData == nil {
+		return nil
+	}
+
+	var prev SecurityAudit
+	if err := json.Unmarshal(prevData, &prev); err != nil {
+		return nil
+	}
+
+	if audit.Score >= prev.Score {
+		return rdb.HDel(ctx, securityAuditRegressionsKey, url).Err()
+	}
+
+	regression, err := json.Marshal(SecurityRegression{
+		URL:           url,
+		PreviousScore: prev.Score,
+		PreviousAt:    prev.AuditedAt,
+		Current:       *audit,
+	})
+	if err != nil {
+		return err
+	}
+	return rdb.HSet(ctx, securityAuditRegressionsKey, url, regression).Err()
+}
+
+func GetSecurityRegressions(ctx context.Context, rdb *redis.Client) ([]SecurityRegression, error) {
+	entries, err := rdb.HGetAll(ctx, securityAuditRegressionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	regressions := make([]SecurityRegression, 0, len(entries))
+	for _, data := range entries {
+		var r SecurityRegression
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			continue
+		}
+		regressions = append(regressions, r)
+	}
+	return regressions, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Run with:
+//   go test security_audit_test.go security_audit.go common.go
+
+func TestAuditCookieSameSite(t *testing.T) {
+	for _, tc := range []struct {
+		cookie string
+		want   string // the SameSite finding, "" for none
+	}{
+		{"session=abc; Secure; HttpOnly", `cookie "session" has no SameSite attribute`},
+		{"session=abc; Secure; HttpOnly; SameSite", `cookie "session" has no SameSite attribute`},
+		{"session=abc; Secure; HttpOnly; SameSite=Lax", ""},
+		{"session=abc; Secure; HttpOnly; SameSite=Strict", ""},
+		{"session=abc; Secure; HttpOnly; SameSite=None", ""},
+		{"session=abc; HttpOnly; SameSite=None", `cookie "session" uses SameSite=None without Secure`},
+	} {
+		resp := &http.Response{Header: http.Header{"Set-Cookie": {tc.cookie}}}
+		audit := AuditSecurityHeaders(resp)
+
+		var got string
+		for _, finding := range audit.Findings {
+			if finding.Check == "cookie" && strings.Contains(finding.Message, "SameSite") {
+				got = finding.Message
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: got finding %q, want %q", tc.cookie, got, tc.want)
+		}
+	}
+}
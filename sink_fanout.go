@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SinkStats counts what happened to the batches handed to one sink
+type SinkStats struct {
+	Name     string
+	Batches  int64 // written successfully
+	Results  int64
+	Retries  int64
+	Failures int64 // given up on after every retry
+	Dropped  int64 // lost: not queued or spooled
+	Queued   int
+
+	// Every write call, and how long and how large they were
+	Attempts   int64
+	Errors     int64 // failed attempts
+	Durations  HistogramSnapshot
+	BatchSizes SizeSnapshot
+
+	// Results the sink skipped as already stored, see DedupingSink
+	Duplicates int64
+
+	// Batches written to the local spool, and replayed from it since
+	Spooled      int64
+	Replayed     int64
+	SpoolBytes   int64
+	SpoolCorrupt int64
+
+	LastError    string
+	LastDuration time.Duration
+}
+
+type sinkRunner struct {
+	sink  ResultSink
+	spool *Spool // nil without SPOOL_DIR
+
+	// Batches waiting for the sink, and the one being written. Spilling to
+	// the spool happens under qmu too, which is what keeps the spool in
+	// arrival order.
+	qmu             sync.Mutex
+	queue           [][]URLResult
+	queueSize       int
+	inflight        []URLResult
+	inflightSpooled bool
+	inflightPos     spoolPos
+	closed          bool
+	wake            chan struct{}
+
+	batches  int64
+	results  int64
+	attempts int64
+	errors   int64
+	retries  int64
+	failures int64
+	dropped  int64
+	spooled  int64
+	replayed int64
+
+	durations *LatencyHistogram
+	sizes     *SizeHistogram
+
+	mu           sync.Mutex
+	lastError    string
+	lastDuration time.Duration
+	avgDuration  time.Duration // moving average of every attempt
+}
+
+// SinkFanout hands every batch to each sink through its own queue and
+// goroutine, so a slow or failing sink only ever delays itself. A sink whose
+// queue is full, or that fails a batch after every retry, gets the batch
+// spooled to local disk instead; the spool is replayed in order once the sink
+// accepts writes again, and new batches queue behind it. Without a spool
+// those batches are lost (counted as dropped or failed).
+type SinkFanout struct {
+	runners []*sinkRunner
+	retries int
+	timeout time.Duration
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// SpoolOptions places each sink's spool in Dir/<sink>; an empty Dir disables
+// spooling
+type SpoolOptions struct {
+	Dir          string
+	SegmentBytes int64
+	MaxBytes     int64
+}
+
+// How often a sink with a non-empty spool retries it while no new batches
+// arrive
+const spoolReplayInterval = 5 * time.Second
+
+// NewSinkFanout starts one goroutine per sink. Each sink buffers up to
+// queueSize batches and gets retries extra attempts per batch, timeout each.
+func NewSinkFanout(sinks []ResultSink, queueSize, retries int, timeout time.Duration, spool SpoolOptions) (*SinkFanout, error) {
+	f := &SinkFanout{
+		retries:  retries,
+		timeout:  timeout,
+		stopChan: make(chan struct{}),
+	}
+	for _, sink := range sinks {
+		r := &sinkRunner{
+			sink:      sink,
+			queueSize: queueSize,
+			wake:      make(chan struct{}, 1),
+			durations: NewLatencyHistogram(),
+			sizes:     NewSizeHistogram(),
+		}
+		if spool.Dir != "" {
+			sp, err := OpenSpool(filepath.Join(spool.Dir, sink.Name()), spool.SegmentBytes, spool.MaxBytes)
+			if err != nil {
+				return nil, fmt.Errorf("spool for result sink %s: %w", sink.Name(), err)
+			}
+			if sp.Pending() {
+				log.Printf("💾 Result sink %s has %d bytes spooled from a previous run\n", sink.Name(), sp.Size())
+			}
+			r.spool = sp
+		}
+		f.runners = append(f.runners, r)
+	}
+	for _, r := range f.runners {
+		f.wg.Add(1)
+		go f.run(r)
+	}
+	return f, nil
+}
+
+// Write queues batch for every sink without blocking. Sinks must not modify
+// it, since they all share it.
+func (f *SinkFanout) Write(batch []URLResult) {
+	for _, r := range f.runners {
+		r.qmu.Lock()
+		if len(r.queue) < r.queueSize {
+			r.queue = append(r.queue, batch)
+		} else {
+			f.overflow(r, batch)
+		}
+		r.qmu.Unlock()
+
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// overflow handles a full queue, with qmu held. With a spool, the batch being
+// written and the queued ones go there first so the new one doesn't overtake
+// them. The one being written is retracted from the spool again if its write
+// succeeds.
+func (f *SinkFanout) overflow(r *sinkRunner, batch []URLResult) {
+	if r.spool != nil {
+		if r.inflight != nil && !r.inflightSpooled {
+			pos, err := r.spool.AppendTentative(r.inflight)
+			if err == nil {
+				atomic.AddInt64(&r.spooled, 1)
+				r.inflightSpooled, r.inflightPos = true, pos
+			} else {
+				log.Printf("❌ Spooling for result sink %s failed: %v\n", r.sink.Name(), err)
+			}
+		}
+		for _, queued := range r.queue {
+			f.spill(r, queued, "is behind")
+		}
+		r.queue = nil
+	}
+	f.spill(r, batch, "is behind")
+}
+
+// spill spools a batch the sink couldn't take, or drops it without a spool.
+// Callers hold qmu.
+func (f *SinkFanout) spill(r *sinkRunner, batch []URLResult, reason string) bool {
+	if r.spool != nil {
+		err := r.spool.Append(batch)
+		if err == nil {
+			atomic.AddInt64(&r.spooled, 1)
+			return true
+		}
+		log.Printf("❌ Spooling for result sink %s failed: %v\n", r.sink.Name(), err)
+	}
+	atomic.AddInt64(&r.dropped, 1)
+	log.Printf("⚠️ Result sink %s %s, dropped %d results\n", r.sink.Name(), reason, len(batch))
+	return false
+}
+
+// next takes the oldest queued batch as the one in flight
+func (r *sinkRunner) next() (batch []URLResult, ok, closed bool) {
+	r.qmu.Lock()
+	defer r.qmu.Unlock()
+	if len(r.queue) == 0 {
+		return nil, false, r.closed
+	}
+	batch = r.queue[0]
+	r.queue[0] = nil
+	r.queue = r.queue[1:]
+	r.inflight, r.inflightSpooled = batch, false
+	return batch, true, false
+}
+
+// finish ends the in-flight batch, spooling it unless it was written or an
+// overflow already spooled it. Replay only runs on this goroutine, so a
+// written batch is retracted before its spooled copy can be replayed.
+func (f *SinkFanout) finish(r *sinkRunner, written bool, reason string) {
+	r.qmu.Lock()
+	defer r.qmu.Unlock()
+	switch {
+	case written && r.inflightSpooled:
+		r.spool.Retract(r.inflightPos)
+		atomic.AddInt64(&r.spooled, -1)
+	case !written && !r.inflightSpooled:
+		f.spill(r, r.inflight, reason)
+	}
+	r.inflight = nil
+}
+
+func (f *SinkFanout) run(r *sinkRunner) {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		batch, ok, closed := r.next()
+		if closed {
+			f.drainSpool(r)
+			return
+		}
+		if !ok {
+			select {
+			case <-r.wake:
+			case <-ticker.C:
+				f.replay(r)
+			}
+			continue
+		}
+
+		// Nothing overtakes what's already spooled
+		if r.spool != nil && r.spool.Pending() {
+			f.finish(r, false, "is replaying its spool")
+			f.replay(r)
+			continue
+		}
+		f.finish(r, f.deliver(r, batch), "failed")
+	}
+}
+
+// replay writes spooled batches in order until the spool is empty or a write
+// fails. Each batch gets a single attempt; the next tick tries again.
+func (f *SinkFanout) replay(r *sinkRunner) {
+	if r.spool == nil || !r.spool.Pending() {
+		return
+	}
+	n, err := r.spool.Replay(func(batch []URLResult) error {
+		return f.write(r, batch)
+	})
+	atomic.AddInt64(&r.replayed, int64(n))
+	if n > 0 {
+		log.Printf("💾 Replayed %d spooled batches to result sink %s\n", n, r.sink.Name())
+	}
+	if err != nil && n > 0 {
+		log.Printf("⚠️ Result sink %s failed again while replaying its spool: %v\n", r.sink.Name(), err)
+	}
+}
+
+// drainSpool is the last replay before the fan-out stops. Whatever the sink
+// still refuses stays on disk for the next start.
+func (f *SinkFanout) drainSpool(r *sinkRunner) {
+	f.replay(r)
+	if r.spool == nil {
+		return
+	}
+	if size := r.spool.Size(); size > 0 {
+		log.Printf("💾 Result sink %s left %d bytes in its spool for the next run\n", r.sink.Name(), size)
+	}
+}
+
+// deliver writes one batch, retrying with exponential backoff, and reports
+// whether it was written. Once the fan-out is stopping, backoffs are skipped,
+// and a sink with a spool goes straight to it, so the drain isn't held up.
+func (f *SinkFanout) deliver(r *sinkRunner, batch []URLResult) bool {
+	backoff := 200 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := f.write(r, batch)
+		if err == nil {
+			return true
+		}
+		if attempt >= f.retries || (r.spool != nil && f.stopping()) {
+			atomic.AddInt64(&r.failures, 1)
+			log.Printf("❌ Result sink %s failed %d times: %v\n", r.sink.Name(), attempt+1, err)
+			return false
+		}
+
+		atomic.AddInt64(&r.retries, 1)
+		select {
+		case <-time.After(backoff):
+		case <-f.stopChan:
+		}
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
+// write makes a single attempt and records its outcome
+func (f *SinkFanout) write(r *sinkRunner, batch []URLResult) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	err := r.sink.Write(ctx, batch)
+	cancel()
+	took := time.Since(start)
+
+	r.durations.Observe(took)
+	r.sizes.Observe(len(batch))
+	atomic.AddInt64(&r.attempts, 1)
+
+	r.mu.Lock()
+	r.lastDuration = took
+	if r.avgDuration == 0 {
+		r.avgDuration = took
+	} else {
+		r.avgDuration += (took - r.avgDuration) / 4
+	}
+	if err != nil {
+		r.lastError = err.Error()
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		atomic.AddInt64(&r.errors, 1)
+	} else {
+		atomic.AddInt64(&r.batches, 1)
+		atomic.AddInt64(&r.results, int64(len(batch)))
+	}
+	return err
+}
+
+// Pressure reports how hard the slowest sink is working: the moving average
+// of its write times, and the most batches any sink has waiting
+func (f *SinkFanout) Pressure() (latency time.Duration, backlog int) {
+	for _, r := range f.runners {
+		r.qmu.Lock()
+		backlog = max(backlog, len(r.queue))
+		r.qmu.Unlock()
+
+		r.mu.Lock()
+		latency = max(latency, r.avgDuration)
+		r.mu.Unlock()
+	}
+	return latency, backlog
+}
+
+func (f *SinkFanout) stopping() bool {
+	select {
+	case <-f.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop delivers everything already queued, then closes the sinks
+func (f *SinkFanout) Stop() {
+	close(f.stopChan)
+	for _, r := range f.runners {
+		r.qmu.Lock()
+		r.closed = true
+		r.qmu.Unlock()
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+	f.wg.Wait()
+
+	for _, r := range f.runners {
+		if err := r.sink.Close(); err != nil {
+			log.Printf("⚠️ Closing result sink %s: %v\n", r.sink.Name(), err)
+		}
+		if r.spool != nil {
+			r.spool.Close()
+		}
+	}
+}
+
+func (f *SinkFanout) Stats() []SinkStats {
+	stats := make([]SinkStats, len(f.runners))
+	for i, r := range f.runners {
+		r.qmu.Lock()
+		queued := len(r.queue)
+		r.qmu.Unlock()
+
+		r.mu.Lock()
+		stats[i] = SinkStats{
+			Name:         r.sink.Name(),
+			Batches:      atomic.LoadInt64(&r.batches),
+			Results:      atomic.LoadInt64(&r.results),
+			Attempts:     atomic.LoadInt64(&r.attempts),
+			Errors:       atomic.LoadInt64(&r.errors),
+			Durations:    r.durations.Snapshot(),
+			BatchSizes:   r.sizes.Snapshot(),
+			Retries:      atomic.LoadInt64(&r.retries),
+			Failures:     atomic.LoadInt64(&r.failures),
+			Dropped:      atomic.LoadInt64(&r.dropped),
+			Queued:       queued,
+			Spooled:      atomic.LoadInt64(&r.spooled),
+			Replayed:     atomic.LoadInt64(&r.replayed),
+			LastError:    r.lastError,
+			LastDuration: r.lastDuration,
+		}
+		if r.spool != nil {
+			stats[i].SpoolBytes = r.spool.Size()
+			stats[i].SpoolCorrupt = r.spool.Corrupt()
+		}
+		if d, ok := r.sink.(DedupingSink); ok {
+			stats[i].Duplicates = d.Duplicates()
+		}
+		r.mu.Unlock()
+	}
+	return stats
+}
+
+func (f *SinkFanout) PrintStats() {
+	fmt.Printf("\n" +
+		"════════════════════════════════════════\n" +
+		"RESULT SINKS\n" +
+		"════════════════════════════════════════\n")
+	for _, s := range f.Stats() {
+		fmt.Printf("%-9s %6d results in %5d batches | retries %d | failed %d | dropped %d | duplicates %d | queued %d | last %s\n",
+			s.Name+":", s.Results, s.Batches, s.Retries, s.Failures, s.Dropped, s.Duplicates, s.Queued,
+			s.LastDuration.Round(time.Millisecond))
+		if s.Attempts > 0 {
+			fmt.Printf("          %d writes (%d failed) | p50 %s p95 %s p99 %s | batch p50 %d p95 %d max≤%d\n",
+				s.Attempts, s.Errors,
+				formatMicros(s.Durations.QuantileUs(0.5)), formatMicros(s.Durations.QuantileUs(0.95)), formatMicros(s.Durations.QuantileUs(0.99)),
+				s.BatchSizes.Quantile(0.5), s.BatchSizes.Quantile(0.95), s.BatchSizes.Quantile(1))
+		}
+		if s.Spooled+s.Replayed+s.SpoolBytes > 0 {
+			fmt.Printf("          spooled %d | replayed %d | %d bytes on disk | corrupt records %d\n",
+				s.Spooled, s.Replayed, s.SpoolBytes, s.SpoolCorrupt)
+		}
+		if s.LastError != "" {
+			fmt.Printf("          last error: %s\n", s.LastError)
+		}
+	}
+	fmt.Println("════════════════════════════════════════")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with:
+//   go test sink_fanout_test.go spool_test.go sink_fanout.go spool.go result_sink.go result_envelope.go cache_codec.go cache_metrics.go flusher_metrics.go check_store.go db_manager.go mongo_model.go config.go common.go
+
+// recordingSink keeps every result it is given, duplicates included, and
+// fails while down. A write blocks until gate is closed, if set.
+type recordingSink struct {
+	mu     sync.Mutex
+	urls   []string
+	down   bool
+	gate   chan struct{}
+	writes chan struct{} // one send per write started, if set
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+func (s *recordingSink) Close() error { return nil }
+
+func (s *recordingSink) Write(ctx context.Context, batch []URLResult) error {
+	if s.writes != nil {
+		s.writes <- struct{}{}
+	}
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("sink down")
+	}
+	for _, result := range batch {
+		s.urls = append(s.urls, result.URL)
+	}
+	return nil
+}
+
+func (s *recordingSink) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *recordingSink) written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.urls...)
+}
+
+func TestFanoutOverflowWritesTheInflightBatchOnce(t *testing.T) {
+	sink := &recordingSink{gate: make(chan struct{}), writes: make(chan struct{}, 10)}
+	fanout, err := NewSinkFanout([]ResultSink{sink}, 1, 0, time.Second,
+		SpoolOptions{Dir: t.TempDir(), SegmentBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fanout.Write(spoolBatch("a"))
+	<-sink.writes // a is in flight
+	fanout.Write(spoolBatch("b"))
+	// The queue is full: a, b and c go to the spool, in that order
+	fanout.Write(spoolBatch("c"))
+
+	close(sink.gate) // a's write succeeds after all
+	fanout.Stop()
+
+	if got := sink.written(); !sameURLs(got, []string{"a", "b", "c"}) {
+		t.Errorf("sink got %v, want a b c once each", got)
+	}
+	if stats := fanout.Stats()[0]; stats.Spooled != 2 || stats.Replayed != 2 {
+		t.Errorf("spooled %d and replayed %d batches, want 2 and 2", stats.Spooled, stats.Replayed)
+	}
+}
+
+func TestFanoutDrainsTheSpoolOnStop(t *testing.T) {
+	dir := t.TempDir()
+	sink := &recordingSink{down: true}
+	fanout, err := NewSinkFanout([]ResultSink{sink}, 10, 0, time.Second,
+		SpoolOptions{Dir: dir, SegmentBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fanout.Write(spoolBatch("a"))
+	fanout.Write(spoolBatch("b"))
+	deadline := time.Now().Add(5 * time.Second)
+	for fanout.Stats()[0].Spooled < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failed batches were not spooled: %+v", fanout.Stats()[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sink.setDown(false)
+	fanout.Stop()
+
+	if got := sink.written(); !sameURLs(got, []string{"a", "b"}) {
+		t.Errorf("sink got %v after stopping, want a b", got)
+	}
+	if files := segmentFiles(t, filepath.Join(dir, sink.Name())); len(files) != 0 {
+		t.Errorf("spool not drained: %v", files)
+	}
+}
+
+func TestFanoutKeepsTheSpoolForTheNextStart(t *testing.T) {
+	dir := t.TempDir()
+	sink := &recordingSink{down: true}
+	fanout, err := NewSinkFanout([]ResultSink{sink}, 10, 0, time.Second,
+		SpoolOptions{Dir: dir, SegmentBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fanout.Write(spoolBatch("a"))
+	fanout.Stop()
+
+	// Still down at shutdown: a waits on disk and is delivered after a restart
+	sink.setDown(false)
+	fanout, err = NewSinkFanout([]ResultSink{sink}, 10, 0, time.Second,
+		SpoolOptions{Dir: dir, SegmentBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fanout.Write(spoolBatch("b"))
+	fanout.Stop()
+
+	if got := sink.written(); !sameURLs(got, []string{"a", "b"}) {
+		t.Errorf("sink got %v, want a then b", got)
+	}
+}
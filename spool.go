@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Spool records are a big-endian payload length and CRC-32C, then the batch
+// as JSON. Segments are named by sequence number so replay order survives a
+// restart.
+const (
+	spoolHeaderSize = 8
+	spoolSegmentExt = ".seg"
+)
+
+var (
+	errSpoolFull    = errors.New("spool is full")
+	errSpoolCorrupt = errors.New("spool record is corrupt")
+
+	spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Spool is an append-only queue of result batches on local disk, split into
+// segments of about segmentBytes and capped at maxBytes in total. Appends may
+// come from any goroutine; Replay must only be called from one at a time.
+// Delivery is at-least-once: a crash mid-segment replays that segment again.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu        sync.Mutex
+	segments  []uint64 // on disk, oldest first
+	nextSeq   uint64
+	writer    *os.File // appends go to the newest segment while this is open
+	writeSize int64
+	readOff   int64 // replay position in segments[0]
+	size      int64
+
+	corrupt int64
+
+	// Records to skip on replay, see Retract
+	retracted map[spoolPos]bool
+}
+
+// spoolPos is where a record starts: its segment and offset
+type spoolPos struct {
+	seq uint64
+	off int64
+}
+
+// OpenSpool picks up segments left by a previous run, which are replayed
+// before anything appended now
+func OpenSpool(dir string, segmentBytes, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, segmentBytes: segmentBytes, maxBytes: maxBytes, nextSeq: 1, retracted: make(map[spoolPos]bool)}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), spoolSegmentExt)
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seq)
+		s.size += info.Size()
+		s.nextSeq = max(s.nextSeq, seq+1)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// Append writes batch as one record and syncs it to disk
+func (s *Spool) Append(batch []URLResult) error {
+	_, err := s.AppendTentative(batch)
+	return err
+}
+
+// AppendTentative is Append for a batch that may still be delivered some
+// other way; Retract the returned position if it is
+func (s *Spool) AppendTentative(batch []URLResult) (spoolPos, error) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return spoolPos{}, err
+	}
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, spoolCRC))
+	copy(record[spoolHeaderSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && s.size+int64(len(record)) > s.maxBytes {
+		return spoolPos{}, errSpoolFull
+	}
+	if s.writer != nil && s.writeSize > 0 && s.writeSize+int64(len(record)) > s.segmentBytes {
+		s.closeWriter()
+	}
+	if s.writer == nil {
+		seq := s.nextSeq
+		file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+		if err != nil {
+			return spoolPos{}, err
+		}
+		s.nextSeq++
+		s.segments = append(s.segments, seq)
+		s.writer, s.writeSize = file, 0
+	}
+
+	pos := spoolPos{seq: s.segments[len(s.segments)-1], off: s.writeSize}
+	n, err := s.writer.Write(record)
+	s.writeSize += int64(n)
+	s.size += int64(n)
+	if err == nil {
+		err = s.writer.Sync()
+	}
+	if err != nil {
+		// Whatever part of the record made it is skipped as corrupt on replay
+		s.closeWriter()
+		return spoolPos{}, err
+	}
+	return pos, nil
+}
+
+// Retract skips the record at pos on replay. It only lasts for this run: after
+// a restart the record is replayed like any other.
+func (s *Spool) Retract(pos spoolPos) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retracted[pos] = true
+}
+
+func (s *Spool) closeWriter() {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+}
+
+// Pending reports whether there is anything left to replay
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) > 0
+}
+
+// Size is the bytes currently on disk
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Corrupt counts records skipped because their checksum or length was bad
+func (s *Spool) Corrupt() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.corrupt
+}
+
+// Replay hands spooled batches to fn oldest first, removing each once fn
+// succeeds. It stops at the first error from fn, which is returned, and
+// reports how many batches were replayed. The lock is not held while fn
+// runs, so appends carry on during a slow replay.
+func (s *Spool) Replay(fn func(batch []URLResult) error) (int, error) {
+	replayed := 0
+	for {
+		batch, next, ok, err := s.peek()
+		if err != nil || !ok {
+			return replayed, err
+		}
+		if batch == nil {
+			// Retracted
+			continue
+		}
+		if err := fn(batch); err != nil {
+			return replayed, err
+		}
+		s.mu.Lock()
+		s.readOff = next
+		s.mu.Unlock()
+		replayed++
+	}
+}
+
+// peek reads the record at the replay position, dropping finished segments
+// and skipping the rest of a segment after a corrupt record. A retracted
+// record is stepped over and returned as a nil batch.
+func (s *Spool) peek() (batch []URLResult, next int64, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.segments) > 0 {
+		seq := s.segments[0]
+		if s.writer != nil && seq == s.segments[len(s.segments)-1] {
+			// Replay has caught up with the segment being written; seal it so
+			// every segment read from here on is complete
+			s.closeWriter()
+		}
+
+		batch, next, err := s.readRecord(seq, s.readOff)
+		if err == nil {
+			if pos := (spoolPos{seq: seq, off: s.readOff}); s.retracted[pos] {
+				delete(s.retracted, pos)
+				s.readOff = next
+				return nil, next, true, nil
+			}
+			return batch, next, true, nil
+		}
+		if errors.Is(err, errSpoolCorrupt) {
+			s.corrupt++
+		} else if !errors.Is(err, io.EOF) {
+			return nil, 0, false, err
+		}
+
+		// Segment finished (or unreadable past this point)
+		path := s.segmentPath(seq)
+		if info, statErr := os.Stat(path); statErr == nil {
+			s.size -= info.Size()
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, 0, false, err
+		}
+		s.segments = s.segments[1:]
+		s.readOff = 0
+	}
+	return nil, 0, false, nil
+}
+
+func (s *Spool) readRecord(seq uint64, off int64) ([]URLResult, int64, error) {
+	file, err := os.Open(s.segmentPath(seq))
+	if os.IsNotExist(err) {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if off >= info.Size() {
+		return nil, 0, io.EOF
+	}
+
+	// A record cut short by a crash, or a length no record could have
+	header := make([]byte, spoolHeaderSize)
+	if off+spoolHeaderSize > info.Size() {
+		return nil, 0, errSpoolCorrupt
+	}
+	if _, err := file.ReadAt(header, off); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if off+spoolHeaderSize+length > info.Size() {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, off+spoolHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, spoolCRC) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	var batch []URLResult
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return nil, 0, errSpoolCorrupt
+	}
+	return batch, off + spoolHeaderSize + length, nil
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeWriter()
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Run with:
+//   go test spool_test.go spool.go common.go config.go
+
+func spoolBatch(url string) []URLResult {
+	return []URLResult{{URL: url, Status: 200}}
+}
+
+func openTestSpool(t *testing.T, dir string, segmentBytes, maxBytes int64) *Spool {
+	t.Helper()
+	spool, err := OpenSpool(dir, segmentBytes, maxBytes)
+	if err != nil {
+		t.Fatalf("open spool: %v", err)
+	}
+	t.Cleanup(func() { spool.Close() })
+	return spool
+}
+
+func appendAll(t *testing.T, spool *Spool, urls ...string) {
+	t.Helper()
+	for _, url := range urls {
+		if err := spool.Append(spoolBatch(url)); err != nil {
+			t.Fatalf("append %s: %v", url, err)
+		}
+	}
+}
+
+// replayAll returns the URL of every replayed batch, in order
+func replayAll(t *testing.T, spool *Spool) []string {
+	t.Helper()
+	var urls []string
+	if _, err := spool.Replay(func(batch []URLResult) error {
+		for _, result := range batch {
+			urls = append(urls, result.URL)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return urls
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func sameURLs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSpoolRotatesSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Every record is bigger than a segment, so each gets its own
+	spool := openTestSpool(t, dir, 1, 0)
+	appendAll(t, spool, "a", "b", "c")
+
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("%d segments on disk, want one per record: %v", len(files), files)
+	}
+	if got := replayAll(t, spool); !sameURLs(got, []string{"a", "b", "c"}) {
+		t.Errorf("replayed %v, want a b c", got)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 || spool.Size() != 0 || spool.Pending() {
+		t.Errorf("replayed segments left behind: %v, %d bytes", files, spool.Size())
+	}
+}
+
+func TestSpoolReplaysInOrderAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 1<<20, 0)
+	appendAll(t, spool, "a", "b")
+	spool.Close()
+
+	spool = openTestSpool(t, dir, 1<<20, 0)
+	if !spool.Pending() {
+		t.Fatal("reopened spool has nothing pending")
+	}
+	appendAll(t, spool, "c")
+	spool.Close()
+
+	spool = openTestSpool(t, dir, 1<<20, 0)
+	appendAll(t, spool, "d")
+	if got := replayAll(t, spool); !sameURLs(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("replayed %v, want a b c d", got)
+	}
+}
+
+func TestSpoolStopsReplayAtTheFirstError(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 1<<20, 0)
+	appendAll(t, spool, "a", "b")
+
+	sinkDown := errors.New("sink down")
+	n, err := spool.Replay(func([]URLResult) error { return sinkDown })
+	if n != 0 || !errors.Is(err, sinkDown) {
+		t.Fatalf("replay = %d, %v; want 0, the sink's error", n, err)
+	}
+	if got := replayAll(t, spool); !sameURLs(got, []string{"a", "b"}) {
+		t.Errorf("replayed %v after the failure, want a b again", got)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 1<<20, 0)
+	appendAll(t, spool, "a")
+	recordSize := spool.Size()
+	spool.Close()
+
+	spool = openTestSpool(t, t.TempDir(), 1<<20, 2*recordSize)
+	appendAll(t, spool, "a", "b")
+	if err := spool.Append(spoolBatch("c")); !errors.Is(err, errSpoolFull) {
+		t.Fatalf("third append: %v, want errSpoolFull", err)
+	}
+	if spool.Size() != 2*recordSize {
+		t.Errorf("size %d after a refused append, want %d", spool.Size(), 2*recordSize)
+	}
+
+	// Replaying frees the space again
+	replayAll(t, spool)
+	appendAll(t, spool, "c")
+}
+
+func TestSpoolSkipsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 1, 0)
+	appendAll(t, spool, "a", "b")
+	spool.Close()
+
+	// Flip the last payload byte of the first segment
+	first := segmentFiles(t, dir)[0]
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(first, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	spool = openTestSpool(t, dir, 1, 0)
+	if got := replayAll(t, spool); !sameURLs(got, []string{"b"}) {
+		t.Errorf("replayed %v, want only b", got)
+	}
+	if spool.Corrupt() != 1 {
+		t.Errorf("%d corrupt records, want 1", spool.Corrupt())
+	}
+}
+
+func TestSpoolSkipsTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 1<<20, 0)
+	appendAll(t, spool, "a", "b")
+	spool.Close()
+
+	// A crash part way through writing b
+	segment := segmentFiles(t, dir)[0]
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segment, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	spool = openTestSpool(t, dir, 1<<20, 0)
+	if got := replayAll(t, spool); !sameURLs(got, []string{"a"}) {
+		t.Errorf("replayed %v, want only a", got)
+	}
+	if spool.Corrupt() != 1 {
+		t.Errorf("%d corrupt records, want the truncated one", spool.Corrupt())
+	}
+	if spool.Pending() || len(segmentFiles(t, dir)) != 0 {
+		t.Error("the truncated segment was not removed")
+	}
+}
+
+func TestSpoolSkipsRetractedRecords(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir(), 1<<20, 0)
+	appendAll(t, spool, "a")
+	pos, err := spool.AppendTentative(spoolBatch("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, spool, "c")
+	spool.Retract(pos)
+
+	if got := replayAll(t, spool); !sameURLs(got, []string{"a", "c"}) {
+		t.Errorf("replayed %v, want a c", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// Run with:
+//   go test ssrf_guard_test.go ssrf_guard.go
+
+func TestSSRFGuardCheck(t *testing.T) {
+	open, err := NewSSRFGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowing, err := NewSSRFGuard([]string{"10.20.0.0/16", "169.254.169.254", "fe80::/10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		guard   *SSRFGuard
+		addr    string
+		blocked bool
+	}{
+		{open, "127.0.0.1", true},
+		{open, "127.8.9.10", true},
+		{open, "::1", true},
+		{open, "10.1.2.3", true},
+		{open, "172.16.0.1", true},
+		{open, "192.168.1.1", true},
+		{open, "fd00::1", true},
+		{open, "169.254.169.254", true},
+		{open, "fe80::1", true},
+		{open, "fe80::1%eth0", true},
+		{open, "0.0.0.0", true},
+		{open, "::", true},
+		{open, "224.0.0.1", true},
+		{open, "ff02::1", true},
+		{open, "255.255.255.255", true},
+		{open, "0.1.2.3", true},
+		{open, "100.100.100.200", true},
+		{open, "192.0.0.170", true},
+		{open, "198.18.0.1", true},
+		{open, "240.0.0.1", true},
+		{open, "64:ff9b::a00:1", true},
+		{open, "2002:a00:1::", true},
+		{open, "::10.0.0.1", true},
+		{open, "::ffff:127.0.0.1", true},
+		{open, "::ffff:10.0.0.1", true},
+		{open, "::ffff:169.254.169.254", true},
+		{open, "93.184.216.34", false},
+		{open, "2606:2800:220:1:248:1893:25c8:1946", false},
+		{open, "::ffff:93.184.216.34", false},
+
+		{allowing, "10.20.1.1", false},
+		{allowing, "::ffff:10.20.1.1", false},
+		{allowing, "10.21.0.1", true},
+		{allowing, "169.254.169.254", false},
+		{allowing, "169.254.169.253", true},
+		{allowing, "fe80::1%eth0", false},
+		{allowing, "127.0.0.1", true},
+	} {
+		err := tc.guard.Check(netip.MustParseAddr(tc.addr))
+		if blocked := err != nil; blocked != tc.blocked {
+			t.Errorf("%s: got %v, want blocked=%v", tc.addr, err, tc.blocked)
+		}
+		if err != nil && !errors.Is(err, ErrSSRFBlocked) {
+			t.Errorf("%s: error %v isn't ErrSSRFBlocked", tc.addr, err)
+		}
+	}
+}
+
+func TestSSRFGuardRejectsBadAllowlist(t *testing.T) {
+	if _, err := NewSSRFGuard([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("an invalid CIDR was accepted")
+	}
+	if _, err := NewSSRFGuard([]string{"intranet"}); err == nil {
+		t.Error("a host name was accepted")
+	}
+}
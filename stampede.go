@@ -1,43 +1,160 @@
 package main
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
 
-type call struct {
-	wg     sync.WaitGroup
-	result URLResult
+// errGoexit is returned when fn called runtime.Goexit instead of returning
+var errGoexit = errors.New("single-flight function called runtime.Goexit")
+
+// PanicError carries a panic from the shared function to every caller
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("single-flight function panicked: %v\n\n%s", p.Value, p.Stack)
+}
+
+type flight[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+
+	// Guarded by SingleFlight.mu until finished is set
+	waiters  int
+	shared   int
+	finished bool
+
+	cancel context.CancelFunc
 }
 
-type StampedePreventer struct {
-	mu       sync.Mutex
-	inFlight map[string]*call
+// SingleFlight de-duplicates concurrent calls for the same key: the first
+// caller starts fn in its own goroutine and every caller waits for the
+// shared result. A panic or error in fn reaches all of them, and each caller
+// may give up on its own context without affecting the others.
+type SingleFlight[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*flight[V]
+
+	flights int64
+	callers int64
 }
 
-func NewStampedePreventer() *StampedePreventer {
-	return &StampedePreventer{
-		inFlight: make(map[string]*call),
+func NewSingleFlight[K comparable, V any]() *SingleFlight[K, V] {
+	return &SingleFlight[K, V]{
+		calls: make(map[K]*flight[V]),
 	}
 }
 
-func (sp *StampedePreventer) Fetch(url string, fetchFunc func(string) URLResult) URLResult {
-	sp.mu.Lock()
+// Do returns fn's result for key along with how many callers shared it. fn
+// runs with a context that is only cancelled once every caller gave up. If fn
+// panics, Do panics with a *PanicError in every caller.
+func (g *SingleFlight[K, V]) Do(ctx context.Context, key K, fn func(context.Context) (V, error)) (V, int, error) {
+	g.mu.Lock()
+	// Counted under the lock so a counted caller has always joined a flight
+	atomic.AddInt64(&g.callers, 1)
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		c.shared++
+		g.mu.Unlock()
+		return g.wait(ctx, key, c)
+	}
 
-	if c, found := sp.inFlight[url]; found {
-		sp.mu.Unlock()
-		c.wg.Wait()
-		return c.result
+	fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &flight[V]{
+		done:    make(chan struct{}),
+		waiters: 1,
+		shared:  1,
+		cancel:  cancel,
 	}
+	g.calls[key] = c
+	atomic.AddInt64(&g.flights, 1)
+	g.mu.Unlock()
 
-	c := &call{}
-	c.wg.Add(1)
-	sp.inFlight[url] = c
-	sp.mu.Unlock()
+	go g.run(fctx, key, c, fn)
+
+	return g.wait(ctx, key, c)
+}
 
-	c.result = fetchFunc(url)
-	c.wg.Done()
+func (g *SingleFlight[K, V]) run(ctx context.Context, key K, c *flight[V], fn func(context.Context) (V, error)) {
+	returned := false
+	defer func() {
+		if !returned {
+			if r := recover(); r != nil {
+				c.err = &PanicError{Value: r, Stack: debug.Stack()}
+			} else {
+				c.err = errGoexit
+			}
+		}
 
-	sp.mu.Lock()
-	delete(sp.inFlight, url)
-	sp.mu.Unlock()
+		g.mu.Lock()
+		c.finished = true
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn(ctx)
+	returned = true
+}
+
+func (g *SingleFlight[K, V]) wait(ctx context.Context, key K, c *flight[V]) (V, int, error) {
+	select {
+	case <-c.done:
+		return c.result()
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	if c.finished {
+		// Finished while we were cancelling: the result is ready, take it
+		g.mu.Unlock()
+		<-c.done
+		return c.result()
+	}
+
+	c.waiters--
+	c.shared--
+	if c.waiters == 0 {
+		// Nobody wants the result any more
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		c.cancel()
+	}
+	g.mu.Unlock()
+
+	var zero V
+	return zero, 0, ctx.Err()
+}
+
+func (c *flight[V]) result() (V, int, error) {
+	if p, ok := c.err.(*PanicError); ok {
+		panic(p)
+	}
+	return c.val, c.shared, c.err
+}
+
+// Forget drops the in-flight call for key so the next Do starts a new one.
+// Callers already waiting still get the original result.
+func (g *SingleFlight[K, V]) Forget(key K) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+}
 
-	return c.result
+// Stats reports how many times fn actually ran versus how many calls were made
+func (g *SingleFlight[K, V]) Stats() (flights, callers int64) {
+	return atomic.LoadInt64(&g.flights), atomic.LoadInt64(&g.callers)
 }
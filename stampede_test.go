@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run with the race detector:
+//   go test -race stampede_test.go stampede.go
+
+func TestSingleFlightSharesOneCall(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	var calls int64
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]int, 50)
+	shared := make([]int, 50)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], shared[i], _ = g.Do(context.Background(), "key", func(context.Context) (int, error) {
+				atomic.AddInt64(&calls, 1)
+				<-release
+				return 42, nil
+			})
+		}()
+	}
+	waitForCallers(t, g, 50)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn ran %d times, want 1", calls)
+	}
+	for i := range results {
+		if results[i] != 42 || shared[i] != 50 {
+			t.Errorf("caller %d got %d with shared=%d, want 42 with shared=50", i, results[i], shared[i])
+		}
+	}
+	if flights, callers := g.Stats(); flights != 1 || callers != 50 {
+		t.Errorf("stats: %d flights, %d callers, want 1 and 50", flights, callers)
+	}
+}
+
+func TestSingleFlightErrorReachesEveryWaiter(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	boom := errors.New("boom")
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	var gotErr int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := g.Do(context.Background(), "key", func(context.Context) (int, error) {
+				<-release
+				return 0, boom
+			})
+			if errors.Is(err, boom) {
+				atomic.AddInt64(&gotErr, 1)
+			}
+		}()
+	}
+	waitForCallers(t, g, 10)
+	close(release)
+	wg.Wait()
+
+	if gotErr != 10 {
+		t.Errorf("%d/10 callers got the error", gotErr)
+	}
+}
+
+func TestSingleFlightPanicReachesEveryWaiter(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	var panics int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if p, ok := recover().(*PanicError); ok && p.Value == "kaboom" {
+					atomic.AddInt64(&panics, 1)
+				}
+			}()
+			g.Do(context.Background(), "key", func(context.Context) (int, error) {
+				<-release
+				panic("kaboom")
+			})
+		}()
+	}
+	waitForCallers(t, g, 10)
+	close(release)
+	wg.Wait()
+
+	if panics != 10 {
+		t.Errorf("%d/10 callers re-panicked with *PanicError", panics)
+	}
+
+	// The key isn't wedged by the panic
+	v, _, err := g.Do(context.Background(), "key", func(context.Context) (int, error) { return 7, nil })
+	if v != 7 || err != nil {
+		t.Errorf("next call on the same key got %d, %v; want 7, nil", v, err)
+	}
+}
+
+func TestSingleFlightGoexit(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(context.Background(), "key", func(context.Context) (int, error) {
+			runtime.Goexit()
+			return 0, nil
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errGoexit) {
+			t.Errorf("caller got %v, want errGoexit", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("caller blocked after Goexit")
+	}
+}
+
+func TestSingleFlightCancelledWaiterLeaves(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		select {
+		case <-release:
+			return 1, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	patient := make(chan [2]int, 1)
+	go func() {
+		v, shared, _ := g.Do(context.Background(), "key", fn)
+		patient <- [2]int{v, shared}
+	}()
+	waitForCallers(t, g, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := g.Do(ctx, "key", fn)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("impatient caller returned %v after %v", err, time.Since(start).Round(time.Millisecond))
+	}
+
+	close(release)
+	if got := <-patient; got[0] != 1 || got[1] != 1 {
+		t.Errorf("patient caller got %d (shared=%d), want 1 (shared=1)", got[0], got[1])
+	}
+}
+
+func TestSingleFlightCancelsFnWhenEveryCallerLeft(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	fnCancelled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.Do(ctx, "key", func(fctx context.Context) (int, error) {
+				<-fctx.Done()
+				close(fnCancelled)
+				return 0, fctx.Err()
+			})
+		}()
+	}
+	waitForCallers(t, g, 5)
+	cancel()
+	wg.Wait()
+
+	select {
+	case <-fnCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fn kept running after all callers left")
+	}
+}
+
+func TestSingleFlightForget(t *testing.T) {
+	g := NewSingleFlight[string, int]()
+	release := make(chan struct{})
+	var calls int64
+	fn := func(context.Context) (int, error) {
+		n := atomic.AddInt64(&calls, 1)
+		<-release
+		return int(n), nil
+	}
+
+	first := make(chan int, 1)
+	go func() {
+		v, _, _ := g.Do(context.Background(), "key", fn)
+		first <- v
+	}()
+	waitForCallers(t, g, 1)
+
+	g.Forget("key")
+	second := make(chan int, 1)
+	go func() {
+		v, _, _ := g.Do(context.Background(), "key", fn)
+		second <- v
+	}()
+	waitForCallers(t, g, 2)
+	close(release)
+
+	if a, b := <-first, <-second; calls != 2 || a == b {
+		t.Errorf("want two separate calls, got %d calls with results %d and %d", calls, a, b)
+	}
+}
+
+func TestSingleFlightStress(t *testing.T) {
+	g := NewSingleFlight[int, int]()
+	var wg sync.WaitGroup
+	var wrong int64
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := rand.Intn(20)
+
+			ctx := context.Background()
+			if rand.Intn(4) == 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(rand.Intn(3))*time.Millisecond)
+				defer cancel()
+			}
+
+			v, shared, err := g.Do(ctx, key, func(fctx context.Context) (int, error) {
+				time.Sleep(time.Duration(rand.Intn(2)) * time.Millisecond)
+				return key * 10, nil
+			})
+			if err == nil && (v != key*10 || shared < 1) {
+				atomic.AddInt64(&wrong, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if wrong != 0 {
+		t.Errorf("%d callers got another key's value", wrong)
+	}
+	if flights, callers := g.Stats(); callers != 2000 || flights > callers {
+		t.Errorf("%d callers shared %d flights", callers, flights)
+	}
+}
+
+// waitForCallers blocks until n calls have reached Do, so tests release fn
+// only after every goroutine joined the flight
+func waitForCallers[K comparable, V any](t *testing.T, g *SingleFlight[K, V], n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, callers := g.Stats(); callers >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d callers", n)
+}
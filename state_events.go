@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Every up/down transition of a target in a region, oldest first
+const stateEventsKey = "state:events"
+
+const (
+	StateUp   = "up"
+	StateDown = "down"
+)
+
+// stateKey holds the last known state of a target as seen from a region. It
+// expires once the target goes unchecked for the tracker's TTL, so removed
+// targets and retired regions don't keep a hash forever.
+func stateKey(region, url string) string {
+	if region == "" {
+		region = defaultRegion
+	}
+	return "state:" + region + ":" + url
+}
+
+// recordStateScript compares and sets the state of one target and, when it
+// changed, appends the transition to the stream in the same step, so two
+// workers can't both report the same change. Results older than the last
+// one recorded (a slow worker, or a cached copy) are ignored, and the first
+// result for a target only sets its state: there is nothing to transition
+// from yet.
+//
+// KEYS: state hash, stream. ARGV: state, checked_at (ms), stream max length,
+// url, region, result envelope, state TTL (ms). Returns the event ID with the previous state
+// and when it began, or nil.
+var recordStateScript = redis.NewScript(`
+local prev = redis.call("HMGET", KEYS[1], "state", "since", "checked_at")
+local checkedAt = tonumber(ARGV[2])
+if prev[3] and tonumber(prev[3]) >= checkedAt then
+	return false
+end
+if prev[1] == ARGV[1] then
+	redis.call("HSET", KEYS[1], "checked_at", ARGV[2])
+	redis.call("PEXPIRE", KEYS[1], ARGV[7])
+	return false
+end
+redis.call("HSET", KEYS[1], "state", ARGV[1], "since", ARGV[2], "checked_at", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[7])
+if not prev[1] then
+	return false
+end
+local id = redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[3], "*",
+	"url", ARGV[4], "region", ARGV[5], "from", prev[1], "to", ARGV[1],
+	"since", prev[2], "duration_ms", checkedAt - tonumber(prev[2]), "result", ARGV[6])
+return {id, prev[1], prev[2]}
+`)
+
+// StateEvent is one transition: the target was From since Since, for
+// DurationMs, until Result put it in To
+type StateEvent struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Region     string    `json:"region"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Since      time.Time `json:"since"`
+	DurationMs int64     `json:"duration_ms"`
+	Result     URLResult `json:"result"`
+}
+
+// ResultState is up for a successful check and down for anything else
+func ResultState(result URLResult) string {
+	if result.Error == "" {
+		return StateUp
+	}
+	return StateDown
+}
+
+// StateTracker keeps the last known state of every target in Redis and
+// publishes the transitions to stateEventsKey, trimmed to about maxLen. A
+// target's state is forgotten after ttl without a check; its next result then
+// only sets the state again.
+type StateTracker struct {
+	rdb    *redis.Client
+	maxLen int64
+	ttl    time.Duration
+
+	published int64
+}
+
+func NewStateTracker(rdb *redis.Client, maxLen int, ttl time.Duration) *StateTracker {
+	return &StateTracker{rdb: rdb, maxLen: int64(maxLen), ttl: ttl}
+}
+
+// Record returns the event when result changed its target's state, or nil
+func (t *StateTracker) Record(ctx context.Context, result URLResult) (*StateEvent, error) {
+	region := result.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	state := ResultState(result)
+	reply, err := recordStateScript.Run(ctx, t.rdb, []string{stateKey(region, result.URL), stateEventsKey},
+		state, result.CheckedAt.UnixMilli(), t.maxLen, result.URL, region, EncodeResult(result), t.ttl.Milliseconds()).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&t.published, 1)
+
+	since, _ := strconv.ParseInt(reply[2], 10, 64)
+	return &StateEvent{
+		ID:         reply[0],
+		URL:        result.URL,
+		Region:     region,
+		From:       reply[1],
+		To:         state,
+		Since:      time.UnixMilli(since),
+		DurationMs: result.CheckedAt.UnixMilli() - since,
+		Result:     result,
+	}, nil
+}
+
+// Published counts the transitions this worker reported
+func (t *StateTracker) Published() int64 {
+	return atomic.LoadInt64(&t.published)
+}
+
+func parseStateEvent(msg redis.XMessage) (StateEvent, error) {
+	field := func(name string) string {
+		s, _ := msg.Values[name].(string)
+		return s
+	}
+	event := StateEvent{
+		ID:     msg.ID,
+		URL:    field("url"),
+		Region: field("region"),
+		From:   field("from"),
+		To:     field("to"),
+	}
+	since, err := strconv.ParseInt(field("since"), 10, 64)
+	if err != nil {
+		return StateEvent{}, fmt.Errorf("state event %s: bad since: %w", msg.ID, err)
+	}
+	event.Since = time.UnixMilli(since)
+	event.DurationMs, _ = strconv.ParseInt(field("duration_ms"), 10, 64)
+	if event.Result, err = DecodeResult([]byte(field("result"))); err != nil {
+		return StateEvent{}, fmt.Errorf("state event %s: %w", msg.ID, err)
+	}
+	return event, nil
+}
+
+// parseStateEvents skips entries that don't parse, returning their IDs
+func parseStateEvents(msgs []redis.XMessage) (events []StateEvent, bad []string) {
+	events = make([]StateEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		event, err := parseStateEvent(msg)
+		if err != nil {
+			bad = append(bad, msg.ID)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, bad
+}
+
+// ValidStateCursor reports whether cursor is a stream ID ("1700000000000-0",
+// or just the milliseconds part); the empty cursor means the oldest event
+func ValidStateCursor(cursor string) bool {
+	if cursor == "" {
+		return true
+	}
+	ms, seq, hasSeq := strings.Cut(cursor, "-")
+	if _, err := strconv.ParseUint(ms, 10, 64); err != nil {
+		return false
+	}
+	if hasSeq {
+		if _, err := strconv.ParseUint(seq, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadStateEvents returns up to count events after cursor, waiting up to
+// wait for the first one if there are none yet, and the cursor to pass next
+// time. Readers that keep their own cursor see every event still in the
+// stream, each exactly once.
+func ReadStateEvents(ctx context.Context, rdb *redis.Client, cursor string, count int64, wait time.Duration) ([]StateEvent, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	block := time.Duration(-1) // no BLOCK argument at all
+	if wait > 0 {
+		block = wait
+	}
+	streams, err := rdb.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{stateEventsKey, cursor},
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, cursor, nil
+	}
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	var msgs []redis.XMessage
+	for _, stream := range streams {
+		msgs = append(msgs, stream.Messages...)
+	}
+	if len(msgs) > 0 {
+		cursor = msgs[len(msgs)-1].ID
+	}
+	events, _ := parseStateEvents(msgs)
+	return events, cursor, nil
+}
+
+// StateEventConsumer reads the stream as one member of a consumer group, so
+// several processes can share the events and each is handled once. Events
+// are redelivered to the same consumer name until acknowledged: after a
+// restart, Next first returns what was read but never acked.
+type StateEventConsumer struct {
+	rdb      *redis.Client
+	group    string
+	consumer string
+	backlog  bool
+}
+
+// NewStateEventConsumer joins group, creating it at the start of the stream
+// if it doesn't exist yet
+func NewStateEventConsumer(ctx context.Context, rdb *redis.Client, group, consumer string) (*StateEventConsumer, error) {
+	err := rdb.XGroupCreateMkStream(ctx, stateEventsKey, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	return &StateEventConsumer{rdb: rdb, group: group, consumer: consumer, backlog: true}, nil
+}
+
+// Next returns up to count events, waiting up to wait when there are none
+func (c *StateEventConsumer) Next(ctx context.Context, count int64, wait time.Duration) ([]StateEvent, error) {
+	if c.backlog {
+		msgs, err := c.read(ctx, "0", count, -1)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 {
+			return c.parse(ctx, msgs)
+		}
+		c.backlog = false
+	}
+
+	block := time.Duration(-1)
+	if wait > 0 {
+		block = wait
+	}
+	msgs, err := c.read(ctx, ">", count, block)
+	if err != nil {
+		return nil, err
+	}
+	return c.parse(ctx, msgs)
+}
+
+// parse acks entries that will never parse, so they don't come back forever
+func (c *StateEventConsumer) parse(ctx context.Context, msgs []redis.XMessage) ([]StateEvent, error) {
+	events, bad := parseStateEvents(msgs)
+	if len(bad) > 0 {
+		if err := c.rdb.XAck(ctx, stateEventsKey, c.group, bad...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (c *StateEventConsumer) read(ctx context.Context, id string, count int64, block time.Duration) ([]redis.XMessage, error) {
+	streams, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.consumer,
+		Streams:  []string{stateEventsKey, id},
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msgs []redis.XMessage
+	for _, stream := range streams {
+		msgs = append(msgs, stream.Messages...)
+	}
+	return msgs, nil
+}
+
+// Ack marks events as handled so they aren't delivered again
+func (c *StateEventConsumer) Ack(ctx context.Context, events ...StateEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return c.rdb.XAck(ctx, stateEventsKey, c.group, ids...).Err()
+}
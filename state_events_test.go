@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Run with:
+//   go test state_events_test.go state_events.go result_envelope.go cache_codec.go config.go common.go
+
+func TestStateTrackerReportsTransitions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	tracker := NewStateTracker(rdb, 1000, time.Hour)
+
+	start := time.Now().Add(-time.Minute)
+	up := URLResult{URL: "https://example.com/", Region: "eu-west", Status: 200, CheckedAt: start}
+	down := up
+	down.Error, down.CheckedAt = "connection refused", start.Add(30*time.Second)
+
+	if event, err := tracker.Record(context.Background(), up); err != nil || event != nil {
+		t.Fatalf("first result = %v, %v; want only the state set", event, err)
+	}
+	event, err := tracker.Record(context.Background(), down)
+	if err != nil || event == nil {
+		t.Fatalf("up to down = %v, %v; want an event", event, err)
+	}
+	if event.From != StateUp || event.To != StateDown || event.DurationMs != 30000 {
+		t.Errorf("event %+v, want up to down after 30s", event)
+	}
+
+	// An older result arriving late changes nothing
+	if event, err := tracker.Record(context.Background(), up); err != nil || event != nil {
+		t.Errorf("stale result = %v, %v; want it ignored", event, err)
+	}
+}
+
+func TestStateExpiresWithoutChecks(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	tracker := NewStateTracker(rdb, 1000, time.Hour)
+
+	result := URLResult{URL: "https://example.com/", Region: "eu-west", Status: 200, CheckedAt: time.Now()}
+	key := stateKey(result.Region, result.URL)
+	if _, err := tracker.Record(context.Background(), result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every check renews the TTL, transition or not
+	mr.FastForward(50 * time.Minute)
+	result.CheckedAt = result.CheckedAt.Add(time.Minute)
+	if _, err := tracker.Record(context.Background(), result); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(50 * time.Minute)
+	if !mr.Exists(key) {
+		t.Fatal("state expired although the target is still checked")
+	}
+
+	mr.FastForward(11 * time.Minute)
+	if mr.Exists(key) {
+		t.Errorf("state of an unchecked target still there after its TTL")
+	}
+}
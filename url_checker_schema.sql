@@ -11,9 +11,21 @@ CREATE TABLE IF NOT EXISTS checks (
     checked_at TIMESTAMPTZ DEFAULT NOW(),
     status_code INT,
     response_time_ms INT,
-    error_message TEXT
+    error_message TEXT,
+    idempotency_key TEXT,
+    run_id TEXT,
+    worker_id TEXT,
+    region TEXT
     );
 
+-- Databases created before idempotency keys
+ALTER TABLE checks ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+
+-- Databases created before exports could filter on them
+ALTER TABLE checks ADD COLUMN IF NOT EXISTS run_id TEXT;
+ALTER TABLE checks ADD COLUMN IF NOT EXISTS worker_id TEXT;
+ALTER TABLE checks ADD COLUMN IF NOT EXISTS region TEXT;
+
 CREATE TABLE IF NOT EXISTS tags (
                                     id SERIAL PRIMARY KEY,
                                     name TEXT NOT NULL UNIQUE
@@ -28,4 +40,10 @@ CREATE TABLE IF NOT EXISTS url_tags (
 -- Indexes from Day 1
 CREATE INDEX IF NOT EXISTS idx_checks_url_id_checked_at ON checks(url_id, checked_at DESC);
 CREATE INDEX IF NOT EXISTS idx_checks_checked_at ON checks(checked_at);
-CREATE INDEX IF NOT EXISTS idx_url_tags_tag_id ON url_tags(tag_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_url_tags_tag_id ON url_tags(tag_id);
+
+-- One row per attempt at a check however often it is delivered
+CREATE UNIQUE INDEX IF NOT EXISTS idx_checks_idempotency_key ON checks(idempotency_key);
+
+-- Exporting one run
+CREATE INDEX IF NOT EXISTS idx_checks_run_id ON checks(run_id);
\ No newline at end of file
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -18,98 +20,19 @@ import (
 )
 
 var (
+	config         AppConfig
 	httpClient     *http.Client
+	dualStack      *DualStackChecker
 	processedCount int64
-	stampede       *StampedePreventer
+	stampede       *SingleFlight[string, URLResult]
 	cacheManager   *CacheManager
 	err            error
 	latencyTracker *LatencyTracker
 )
 
-type ResultsFlusher struct {
-	rdb         *redis.Client
-	resultsChan chan URLResult
-	stopChan    chan struct{}
-	wg          sync.WaitGroup
-}
-
-func NewResultsFlusher(rdb *redis.Client) *ResultsFlusher {
-	f := &ResultsFlusher{
-		rdb:         rdb,
-		resultsChan: make(chan URLResult, 1000),
-		stopChan:    make(chan struct{}),
-	}
-	f.wg.Add(1)
-	go f.run()
-	return f
-}
-
-func (f *ResultsFlusher) Add(ctx context.Context, result URLResult) {
-	select {
-	case f.resultsChan <- result:
-	//Buffer successfully
-	default:
-		data, _ := json.Marshal(result)
-		f.rdb.LPush(ctx, "results", data)
-		log.Println("⚠️ Flusher channel full, direct write fallback")
-	}
-}
-
-func (f *ResultsFlusher) run() {
-	defer f.wg.Done()
-
-	batch := make([]URLResult, 0, 500)
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	flush := func() {
-		if len(batch) == 0 {
-			return
-		}
-
-		args := make([]interface{}, len(batch))
-		for i, result := range batch {
-			data, _ := json.Marshal(result)
-			args[i] = data
-		}
-
-		ctx := context.Background()
-		if err := f.rdb.LPush(ctx, "results", args...).Err(); err != nil {
-			log.Printf("❌ Flush failed: %v\n", err)
-		} else {
-			log.Printf("📦 Flushed %d results to Redis\n", len(batch))
-		}
-
-		batch = batch[:0]
-	}
-
-	for {
-		select {
-		case result := <-f.resultsChan:
-			batch = append(batch, result)
-
-			if len(batch) >= 500 {
-				flush()
-			}
-
-		case <-ticker.C:
-			flush()
-		case <-f.stopChan:
-			flush()
-			return
-		}
-	}
-}
-
-func (f *ResultsFlusher) Stop() {
-	close(f.stopChan)
-	f.wg.Wait()
-	close(f.resultsChan)
-}
-
 func main() {
 	//Load config
-	config := LoadConfig()
+	config = LoadConfig()
 
 	dbm, err := NewDBManager(config.LeaderDSN, config.FollowerDSN)
 	if err != nil {
@@ -117,16 +40,31 @@ func main() {
 	}
 	defer dbm.Close()
 
+	var guard *SSRFGuard
+	if config.SSRFProtection {
+		guard, err = NewSSRFGuard(config.SSRFAllowlist)
+		if err != nil {
+			log.Fatalf("could not create SSRF guard: %v\n", err)
+		}
+	}
+
 	//Setup HTTP client
+	httpTimeout := time.Duration(config.HTTPTimeout) * time.Second
 	httpClient = &http.Client{
-		Timeout: time.Duration(config.HTTPTimeout) * time.Second,
+		Timeout: httpTimeout,
 		Transport: &http.Transport{
+			DialContext:         guard.Dialer(httpTimeout).DialContext,
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 100,
 			IdleConnTimeout:     90 * time.Second,
+			ForceAttemptHTTP2:   true,
 		},
 	}
 
+	if config.DualStack {
+		dualStack = NewDualStackChecker(httpTimeout, guard)
+	}
+
 	workerID := fmt.Sprintf("worker-%d", os.Getpid())
 	if len(os.Args) > 1 {
 		// Last arg that's not a .go file
@@ -137,53 +75,194 @@ func main() {
 		}
 	}
 
+	region := config.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	config.Region = region
+	queueKey := QueueKey(region)
+
 	rdb := NewRedisClient(config.RedisAddr)
 	defer rdb.Close()
 
-	flusher := NewResultsFlusher(rdb)
+	rdb.SAdd(ctx, regionsKey, region)
+
+	sinks, err := BuildResultSinks(config.ResultSinks, config, rdb, dbm)
+	if err != nil {
+		log.Printf("[%s] ❌ invalid result sinks: %v\n", workerID, err)
+		os.Exit(1)
+	}
+	fanout, err := NewSinkFanout(sinks, config.SinkQueueSize, config.SinkRetries, time.Duration(config.SinkTimeout)*time.Second,
+		SpoolOptions{
+			Dir:          config.SpoolDir,
+			SegmentBytes: int64(config.SpoolSegmentMB) << 20,
+			MaxBytes:     int64(config.SpoolMaxMB) << 20,
+		})
+	if err != nil {
+		log.Printf("[%s] ❌ failed to open result spool: %v\n", workerID, err)
+		os.Exit(1)
+	}
+
+	var spill *Spool
+	if config.SpoolDir != "" {
+		spill, err = OpenSpool(filepath.Join(config.SpoolDir, "flusher"), int64(config.SpoolSegmentMB)<<20, int64(config.SpoolMaxMB)<<20)
+		if err != nil {
+			log.Printf("[%s] ❌ failed to open result spool: %v\n", workerID, err)
+			os.Exit(1)
+		}
+	}
+	flusher, err := NewResultsFlusher(fanout, FlusherOptions{
+		QueueSize:    config.FlushQueueSize,
+		Policy:       BackpressurePolicy(config.FlushBackpressure),
+		BlockTimeout: time.Duration(config.FlushBlockTimeoutMs) * time.Millisecond,
+		Spool:        spill,
+		BatchMin:     config.FlushBatchMin,
+		BatchMax:     config.FlushBatchMax,
+		IntervalMin:  time.Duration(config.FlushIntervalMinMs) * time.Millisecond,
+		IntervalMax:  time.Duration(config.FlushIntervalMaxMs) * time.Millisecond,
+	})
+	if err != nil {
+		log.Printf("[%s] ❌ invalid results flusher settings: %v\n", workerID, err)
+		os.Exit(1)
+	}
 	defer flusher.Stop()
 
-	stampede = NewStampedePreventer()
+	if config.ResultsToKeep > 0 {
+		var archive ResultSink
+		if config.ResultsArchive != "" {
+			if config.ResultsArchive == "redis" {
+				log.Printf("[%s] ❌ the results archive can't be the results list itself\n", workerID)
+				os.Exit(1)
+			}
+			archiveConfig := config
+			archiveConfig.ResultsFile = config.ResultsArchiveFile
+			archives, err := BuildResultSinks([]string{config.ResultsArchive}, archiveConfig, rdb, dbm)
+			if err != nil {
+				log.Printf("[%s] ❌ invalid results archive: %v\n", workerID, err)
+				os.Exit(1)
+			}
+			archive = archives[0]
+			defer archive.Close()
+		}
+		housekeeper := NewResultsHousekeeper(rdb, config.ResultsToKeep, archive, workerID, time.Duration(config.ResultsTrimInterval)*time.Second)
+		go housekeeper.Run(ctx)
+	}
+
+	stampede = NewSingleFlight[string, URLResult]()
+
+	cachePolicy, err := NewCachePolicy(config)
+	if err != nil {
+		log.Printf("[%s] ❌ invalid cache policy: %v\n", workerID, err)
+		os.Exit(1)
+	}
+
+	tiers, err := BuildCacheChain(config.CacheTiers, cachePolicy, region, rdb, dbm)
+	if err != nil {
+		log.Printf("[%s] ❌ invalid cache tiers: %v\n", workerID, err)
+		os.Exit(1)
+	}
+
+	var distributed *DistributedStampede
+	if config.DistributedStampede && slices.Contains(config.CacheTiers, "redis") {
+		// The holder renews its lease while it fetches, so the TTL only
+		// bounds how long a crashed holder blocks a key
+		leaseTTL := httpTimeout + 2*time.Second
+		if config.StampedeLeaseMs > 0 {
+			leaseTTL = time.Duration(config.StampedeLeaseMs) * time.Millisecond
+		}
+		// Waiters give up only after a whole fetchOrigin: the main fetch,
+		// then the dual-stack check (a lookup and a fetch per family, each
+		// with its own timeout) and the security audit
+		fetchTime := httpTimeout
+		if config.DualStack {
+			fetchTime += 2 * httpTimeout
+		}
+		waitTimeout := max(fetchTime, leaseTTL) + 3*time.Second
+		if config.StampedeWaitMs > 0 {
+			waitTimeout = time.Duration(config.StampedeWaitMs) * time.Millisecond
+		}
+		distributed = NewDistributedStampede(rdb, workerID, leaseTTL, waitTimeout)
+		go distributed.Listen(ctx)
+	}
 
-	cacheManager, err = NewCacheManager(1000, rdb, stampede)
+	cacheManager, err = NewCacheManager(cachePolicy, tiers, stampede, distributed)
 	if err != nil {
 		log.Printf("[%s] ❌ failed to create cache manager: %v\n", workerID, err)
 		os.Exit(1)
 	}
+	log.Printf("[%s] 🗄️  Cache tiers: %v\n", workerID, cacheManager.Tiers())
+
+	go cacheManager.ListenForInvalidations(ctx, rdb)
+
+	if config.CacheWarmTopN > 0 {
+		hot, err := HotKeys(ctx, rdb, region, config.CacheWarmTopN)
+		if err != nil {
+			log.Printf("[%s] ⚠️ Failed to read hot keys: %v\n", workerID, err)
+		}
+		loaded := cacheManager.Preload(ctx, hot)
+		log.Printf("[%s] 🔥 Pre-loaded %d of %d hot keys into L1\n", workerID, loaded, len(hot))
+	}
+
+	// Publish cache metrics for the monitor to aggregate across workers, and
+	// the hottest keys for the next worker's pre-load
+	go func() {
+		ticker := time.NewTicker(cacheMetricsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := PublishCacheMetrics(ctx, rdb, cacheManager.Metrics(workerID)); err != nil {
+				log.Printf("[%s] ⚠️ Failed to publish cache metrics: %v\n", workerID, err)
+			}
+			if err := RecordHotKeys(ctx, rdb, region, cacheManager.HotKeys(hotKeysLimit)); err != nil {
+				log.Printf("[%s] ⚠️ Failed to record hot keys: %v\n", workerID, err)
+			}
+			if err := PublishFlusherMetrics(ctx, rdb, flusher.Metrics(workerID)); err != nil {
+				log.Printf("[%s] ⚠️ Failed to publish flusher metrics: %v\n", workerID, err)
+			}
+		}
+	}()
 
 	latencyTracker = NewLatencyTracker()
 
-	log.Printf("[%s] 🚀 Starting...\n", workerID)
+	var consensus *ConsensusAggregator
+	if config.ConsensusRequired > 0 {
+		// The regions set only grows, so it can't tell how many locations
+		// are still voting; CONSENSUS_LOCATIONS has to say
+		consensus, err = NewConsensusAggregator(rdb, config.ConsensusRequired, config.ConsensusLocations,
+			time.Duration(config.ConsensusWindow)*time.Second, config.ConsensusKeep)
+		if err != nil {
+			log.Printf("[%s] ❌ invalid consensus settings (CONSENSUS_REQUIRED, CONSENSUS_LOCATIONS, CONSENSUS_WINDOW, CONSENSUS_KEEP): %v\n", workerID, err)
+			os.Exit(1)
+		}
+		defer consensus.Stop()
+		log.Printf("[%s] 🗳️  Consensus: down when %d of %d locations agree\n", workerID, config.ConsensusRequired, config.ConsensusLocations)
+	}
+
+	var stateTracker *StateTracker
+	if config.StateEvents {
+		stateTracker = NewStateTracker(rdb, config.StateEventsMaxLen, time.Duration(config.StateTTL)*time.Second)
+	}
+
+	log.Printf("[%s] 🚀 Starting in region %s (queue %s)...\n", workerID, region, queueKey)
 
-	//Graceful Shutdown
+	//Graceful Shutdown: stop taking work, finish the item in hand, then flush
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	popCtx, stopPopping := context.WithCancel(ctx)
 
 	go func() {
 		<-sigChan
 		log.Printf("\n[%s] 🛑 Shutting down gracefully...", workerID)
-		log.Printf("[%s] 📊 Processed %d URLs in this session", workerID, atomic.LoadInt64(&processedCount))
-
-		// ✅ NEW: Flush remaining batch before exit
-		flusher.Stop()
-		log.Printf("[%s] ✅ All batches flushed", workerID)
-
-		// New: Print stats
-		PrintCacheStats(workerID)
-		latencyTracker.PrintStats()
-
-		os.Exit(0)
-
+		stopPopping()
 	}()
 
 	maxRetries := config.MaxRetries
 	retryCount := 0
 
 	//Main processing loop
-	for {
-		result, err := rdb.BRPop(ctx, time.Duration(config.WorkerTimeout)*time.Second, "url_queue").Result()
+	for popCtx.Err() == nil {
+		result, err := rdb.BRPop(popCtx, time.Duration(config.WorkerTimeout)*time.Second, queueKey).Result()
 		if err != nil {
-			if errors.Is(err, redis.Nil) {
+			if errors.Is(err, redis.Nil) || popCtx.Err() != nil {
 				continue
 			}
 
@@ -204,18 +283,38 @@ func main() {
 
 		retryCount = 0
 
-		url := result[1]
+		item := ParseQueueItem(result[1])
+		url := item.URL
 
 		rdb.Incr(ctx, "processing")
 
-		urlResult := checkURL(url, workerID, rdb)
+		urlResult := checkURL(item, workerID, rdb)
+		stampCheck(&urlResult, item)
 
 		flusher.Add(ctx, urlResult)
+		if consensus != nil {
+			consensus.Vote(ctx, urlResult)
+		}
+		if stateTracker != nil {
+			event, err := stateTracker.Record(ctx, urlResult)
+			if err != nil {
+				log.Printf("[%s] ⚠️ Failed to record state of %s: %v\n", workerID, url, err)
+			} else if event != nil {
+				log.Printf("[%s] 🔀 %s went %s after %s %s\n", workerID, url, event.To,
+					(time.Duration(event.DurationMs) * time.Millisecond).Round(time.Second), event.From)
+			}
+		}
 
 		if urlResult.Error == "" {
 			rdb.Incr(ctx, "success")
+			rdb.Incr(ctx, RegionCounterKey("success", region))
 		} else {
 			rdb.Incr(ctx, "error")
+			rdb.Incr(ctx, RegionCounterKey("error", region))
+		}
+		if urlResult.PartialOutage {
+			rdb.Incr(ctx, "partial_outage")
+			log.Printf("[%s] ⚠️ Partial outage: %s fails on one address family\n", workerID, url)
 		}
 		rdb.Decr(ctx, "processing")
 
@@ -230,33 +329,28 @@ func main() {
 			latencyTracker.PrintStats()
 		}
 	}
-}
 
-func checkURL(url string, workerID string, rdb *redis.Client) URLResult {
-	start := time.Now()
-	result := cacheManager.Get(ctx, url, func(u string) URLResult {
-		fetchStart := time.Now()
-		res := URLResult{
-			URL:       u,
-			WorkerID:  workerID,
-			CheckedAt: fetchStart,
-		}
+	log.Printf("[%s] 📊 Processed %d URLs in this session", workerID, atomic.LoadInt64(&processedCount))
 
-		resp, err := httpClient.Get(u)
-		if err != nil {
-			res.Error = err.Error()
-			res.Duration = time.Since(fetchStart).Milliseconds()
-			return res
-		}
-		defer resp.Body.Close()
+	// Nothing calls flusher.Add any more, so the last batches are complete
+	flusher.Stop()
+	log.Printf("[%s] ✅ All batches flushed", workerID)
+	flusher.PrintStats()
 
-		res.Status = resp.StatusCode
-		res.Duration = time.Since(fetchStart).Milliseconds()
+	PublishCacheMetrics(ctx, rdb, cacheManager.Metrics(workerID))
+	PublishFlusherMetrics(ctx, rdb, flusher.Metrics(workerID))
+	PrintCacheStats(workerID)
+	latencyTracker.PrintStats()
 
-		if resp.StatusCode != 200 {
-			res.Error = fmt.Sprintf("[%s] HTTP %d", workerID, resp.StatusCode)
-		}
+	os.Exit(0)
+}
 
+func checkURL(item QueueItem, workerID string, rdb *redis.Client) URLResult {
+	start := time.Now()
+	result := cacheManager.Get(ctx, item.URL, item.Freshness, func(u string) URLResult {
+		// The cached copy remembers which check fetched it
+		res := fetchOrigin(u, workerID, rdb)
+		stampCheck(&res, item)
 		return res
 	})
 
@@ -266,32 +360,136 @@ func checkURL(url string, workerID string, rdb *redis.Client) URLResult {
 	return result
 }
 
+// stampCheck records the check a result answers. Results served from cache
+// answer the current check, not the one that fetched them.
+func stampCheck(res *URLResult, item QueueItem) {
+	res.CheckID = item.CheckID
+	res.RunID = item.RunID
+	res.Attempt = max(item.Attempt, 1)
+	res.CheckType = CheckTypeHTTP
+	if dualStack != nil {
+		res.CheckType = CheckTypeDualStack
+	}
+	res.IdempotencyKey = IdempotencyKey(*res)
+}
+
+func fetchOrigin(u string, workerID string, rdb *redis.Client) (res URLResult) {
+	fetchStart := time.Now()
+	res = URLResult{
+		URL:       u,
+		WorkerID:  workerID,
+		Region:    config.Region,
+		CheckedAt: fetchStart,
+	}
+
+	if dualStack != nil {
+		defer func() {
+			res.Families, res.PartialOutage = dualStack.Check(ctx, u)
+		}()
+	}
+
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		res.Error = err.Error()
+		res.Duration = time.Since(fetchStart).Milliseconds()
+		if errors.Is(err, ErrSSRFBlocked) {
+			res.ErrorKind = ErrorKindSSRFBlocked
+			rdb.Incr(ctx, "ssrf_blocked")
+			log.Printf("[%s] 🛡️  Blocked outbound request: %v\n", workerID, err)
+		}
+		return res
+	}
+	defer resp.Body.Close()
+
+	res.Status = resp.StatusCode
+	res.Duration = time.Since(fetchStart).Milliseconds()
+	res.Protocol = negotiatedProtocol(resp)
+
+	if resp.StatusCode != 200 {
+		res.Error = fmt.Sprintf("[%s] HTTP %d", workerID, resp.StatusCode)
+	}
+
+	if config.SecurityAudit {
+		res.SecurityAudit = AuditSecurityHeaders(resp)
+		if err := RecordSecurityAudit(ctx, rdb, u, res.SecurityAudit); err != nil {
+			log.Printf("[%s] ⚠️ Failed to record security audit for %s: %v\n", workerID, u, err)
+		}
+	}
+
+	return res
+}
+
 func PrintCacheStats(workerID string) {
-	l1, l2, origin := cacheManager.GetStats()
+	metrics := cacheManager.Metrics(workerID)
 
-	total := l1 + l2 + origin
+	total := metrics.CacheHits() - metrics.StaleServes + metrics.Origin
 	if total == 0 {
 		return
 	}
 
-	l1Pct := (float64(l1) / float64(total)) * 100
-	l2Pct := (float64(l2) / float64(total)) * 100
-	originPct := (float64(origin) / float64(total)) * 100
+	// One line per tier with its measured lookup latency, p50 / p99
+	var tierLines strings.Builder
+	for _, tier := range metrics.Tiers {
+		label, kind, _ := strings.Cut(tier, "=")
+		hits := metrics.Hits[label]
+		lat := metrics.Latency[label]
+		fmt.Fprintf(&tierLines, "%-11s %5d (%5.1f%%)  ← p50 %s, p99 %s\n",
+			fmt.Sprintf("%s %s:", strings.ToUpper(label), kind), hits, float64(hits)/float64(total)*100,
+			formatMicros(lat.QuantileUs(0.5)), formatMicros(lat.QuantileUs(0.99)))
+	}
+	originLat := metrics.Latency["origin"]
+	originPct := float64(metrics.Origin) / float64(total) * 100
 
 	log.Printf("\n"+
 		"════════════════════════════════════════\n"+
 		"[%s] 📊 CACHE STATS (Total: %d)\n"+
 		"════════════════════════════════════════\n"+
-		"L1 hits:    %5d (%5.1f%%)  ← ~1µs latency\n"+
-		"L2 hits:    %5d (%5.1f%%)  ← ~1ms latency\n"+
-		"Origin:     %5d (%5.1f%%)  ← ~100ms latency\n"+
+		"%s"+
+		"Origin:     %5d (%5.1f%%)  ← p50 %s, p99 %s\n"+
 		"════════════════════════════════════════\n"+
-		"Cache efficiency: %.1f%% (L1+L2)\n"+
+		"Cache efficiency: %.1f%%\n"+
+		"Evictions: %d | Misses: %v | Errors: %v\n"+
 		"════════════════════════════════════════\n",
 		workerID, total,
-		l1, l1Pct,
-		l2, l2Pct,
-		origin, originPct,
-		l1Pct+l2Pct,
+		tierLines.String(),
+		metrics.Origin, originPct, formatMicros(originLat.QuantileUs(0.5)), formatMicros(originLat.QuantileUs(0.99)),
+		100-originPct,
+		metrics.Evictions, metrics.Misses, metrics.Errors,
 	)
+
+	ruleStats := cacheManager.GetRuleStats()
+	names := make([]string, 0, len(ruleStats))
+	for name := range ruleStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	flights, callers := cacheManager.GetStampedeStats()
+	log.Printf("[%s] 🧵 Single-flight: %d callers shared %d origin loads\n", workerID, callers, flights)
+
+	staleServes, refreshAhead := cacheManager.GetRefreshStats()
+	log.Printf("[%s] ♻️  Stale serves: %d | Refresh-ahead: %d\n", workerID, staleServes, refreshAhead)
+
+	if decodeErrors := cacheManager.GetDecodeErrors(); decodeErrors > 0 {
+		log.Printf("[%s] 🧩 Undecodable cache entries (served as misses): %d\n", workerID, decodeErrors)
+	}
+
+	log.Printf("[%s] 📐 Cache stats by policy rule (hits per tier):\n", workerID)
+	for _, name := range names {
+		s := ruleStats[name]
+		var hits int64
+		for _, n := range s.Hits {
+			hits += n
+		}
+		if hits+s.Misses+s.StaleServes == 0 {
+			continue
+		}
+		log.Printf("  %-24s Hits: %v | Miss: %6d | Stale: %6d\n", name, s.Hits, s.Misses, s.StaleServes)
+	}
+
+	log.Printf("[%s] 🌐 Hit ratio by domain (busiest first):\n", workerID)
+	for _, domain := range TopDomains(metrics.Domains, 10) {
+		d := metrics.Domains[domain]
+		log.Printf("  %-32s %5.1f%% of %d\n", domain, d.HitRatio()*100, d.Hits+d.Misses)
+	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Run with the worker's files:
+//   go test worker_test.go worker.go common.go config.go cache_manager.go stampede.go latency_tracker.go db_manager.go security_audit.go dualstack.go consensus.go ssrf_guard.go cache_policy.go cache_invalidation.go distributed_stampede.go cache_codec.go cache_metrics.go cache_warmup.go cache_tier.go check_store.go result_sink.go sink_fanout.go mongo_model.go spool.go results_flusher.go flusher_metrics.go results_retention.go result_envelope.go state_events.go
+
+func TestFetchOriginBlocksRedirectToInternal(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	// The allowlisted 127.0.0.1 stands in for a public host, which
+	// redirects to another loopback address
+	internal := "http://127.0.0.2:9/latest/meta-data/"
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal, http.StatusFound)
+	}))
+	defer public.Close()
+
+	guard, err := NewSSRFGuard([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient = &http.Client{
+		Timeout:   2 * time.Second,
+		Transport: &http.Transport{DialContext: guard.Dialer(2 * time.Second).DialContext},
+	}
+
+	res := fetchOrigin(public.URL, "worker-test", rdb)
+	if res.ErrorKind != ErrorKindSSRFBlocked || !strings.Contains(res.Error, "127.0.0.2") {
+		t.Errorf("redirect to %s came back as kind %q, error %q", internal, res.ErrorKind, res.Error)
+	}
+	if n, _ := rdb.Get(ctx, "ssrf_blocked").Int(); n != 1 {
+		t.Errorf("ssrf_blocked counter is %d, want 1", n)
+	}
+}